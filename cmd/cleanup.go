@@ -1,8 +1,8 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"giruno/internals"
 	"log"
 	"os"
 	"os/signal"
@@ -10,6 +10,9 @@ import (
 	"syscall"
 	"time"
 
+	"giruno/internals"
+
+	"github.com/hashicorp/nomad/api"
 	"github.com/spf13/cobra"
 )
 
@@ -26,7 +29,7 @@ var cleanupCmd = &cobra.Command{
 		signal.Ignore(syscall.SIGTERM)
 
 		log.Println("Cleaning up environment")
-		nomad, err := internals.NewNomad(Config)
+		nomad, err := newNomad(Config)
 		if err != nil {
 			return err
 		}
@@ -34,35 +37,68 @@ var cleanupCmd = &cobra.Command{
 		log.Println("Waiting for job allocation")
 		alloc, dead, err := nomad.WaitForAllocation(id)
 		if err != nil {
-			return err
+			// The job may still be queued if prepare gave up waiting for its
+			// placement, deregister it anyway.
+			log.Println(err)
+		} else {
+			log.Println(alloc.ID)
 		}
-		log.Println(alloc.ID)
 
-		if !dead {
-			log.Println("Stopping allocation")
-			var shell string
-			for {
-				time.Sleep(time.Second)
-				logs, err := nomad.GetTaskLogs(alloc, "job", "stdout")
-				if err != nil {
-					return err
-				}
-				if logs != "" {
-					shell = strings.Trim(logs, " \n\t\r")
-					break
-				}
-			}
-			log.Println("Using job shell " + shell)
-			nomad.Exec(alloc, "job", []string{
-				shell,
-			}, strings.NewReader("echo > /tmp/giruno/stop_task"), os.Stdout, os.Stderr)
+		if err == nil && !dead {
+			stopAllocation(nomad, alloc)
 		}
 
+		// The builds slot and the token are released even if the job cannot
+		// be deregistered, they would otherwise only expire with their TTL.
+		var errs []error
 		log.Println("Deregistering job")
-		return nomad.DeregisterJob(id)
+		err = nomad.DeregisterJob(id)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if lock, ok := os.LookupEnv("JOB_ENV_BUILDS_LOCK"); ok {
+			log.Println("Releasing builds slot")
+			err = nomad.ReleaseLock(lock, id)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if accessor, ok := os.LookupEnv("JOB_ENV_NOMAD_TOKEN_ACCESSOR"); ok {
+			log.Println("Revoking Nomad token")
+			err = nomad.Logout(accessor)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
 	},
 }
 
+// stopAllocation asks the exec script of the job task to exit, so that the
+// allocation stops gracefully before the job is deregistered.
+func stopAllocation(nomad internals.NomadClient, alloc *api.Allocation) {
+	log.Println("Stopping allocation")
+	var shell string
+	for {
+		time.Sleep(time.Second)
+		logs, err := nomad.GetTaskLogs(alloc, "job", "stdout")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if logs != "" {
+			shell = strings.Trim(logs, " \n\t\r")
+			break
+		}
+	}
+	log.Println("Using job shell " + shell)
+	nomad.Exec(alloc, "job", []string{
+		shell,
+	}, strings.NewReader("echo > /tmp/giruno/stop_task"), os.Stdout, os.Stderr)
+}
+
 func init() {
 	rootCmd.AddCommand(cleanupCmd)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"giruno/gitlab"
 	"giruno/internals"
+	"log"
 	"os"
 	"path"
 
@@ -18,24 +19,104 @@ var configCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		id := fmt.Sprintf("runner-%s-project-%s-job-%s",
 			os.Getenv("CUSTOM_ENV_CI_RUNNER_ID"),
-			os.Getenv("CUSTOM_ENV_CI_PROJECT_ID"),
-			os.Getenv("CUSTOM_ENV_CI_JOB_ID"))
+			Identity.ProjectID,
+			Identity.JobID)
+
+		cluster, err := internals.SelectCluster(Config)
+		if err != nil {
+			return err
+		}
 
 		settings := map[string]string{
-			"JOB_ENV_ID": id,
+			"JOB_ENV_ID":            id,
+			"JOB_ENV_NOMAD_CLUSTER": cluster,
+		}
+
+		err = useCluster(cluster)
+		if err != nil {
+			return err
+		}
+		if Config.Nomad.AuthMethod != "" {
+			jwt := os.Getenv("CUSTOM_ENV_" + Config.Nomad.AuthJWTVariable)
+			if jwt == "" {
+				return fmt.Errorf("no %s set for Nomad auth method '%s'", Config.Nomad.AuthJWTVariable, Config.Nomad.AuthMethod)
+			}
+			nomad, err := newNomad(Config)
+			if err != nil {
+				return err
+			}
+			token, err := nomad.Login(Config.Nomad.AuthMethod, jwt)
+			if err != nil {
+				return fmt.Errorf("cannot login with Nomad auth method '%s': %w", Config.Nomad.AuthMethod, err)
+			}
+			settings["JOB_ENV_NOMAD_TOKEN"] = token.SecretID
+			settings["JOB_ENV_NOMAD_TOKEN_ACCESSOR"] = token.AccessorID
+			Config.Nomad.Token = token.SecretID
 		}
 
-		project_path := os.Getenv("CUSTOM_ENV_CI_PROJECT_PATH")
+		project_path := Identity.ProjectPath
+		builds_dir := path.Join(Config.Job.AllocDataDir, "builds", project_path)
+		builds_dir_is_shared := false
+		if Config.Job.Builds != nil {
+			slot, lock, err := acquireBuildsSlot(id)
+			if err != nil {
+				return err
+			}
+			if lock != "" {
+				builds_dir = Config.Job.Builds.Dir(project_path, slot)
+				builds_dir_is_shared = true
+				settings["JOB_ENV_BUILDS_LOCK"] = lock
+			} else {
+				log.Println("All builds slots of the project are in use, using a new builds directory")
+			}
+		}
+		cache_dir := path.Join(Config.Job.AllocDataDir, "cache", project_path)
+		if Config.Job.Cache != nil {
+			cache_dir, err = Config.Job.Cache.Dir(ciVariables())
+			if err != nil {
+				return err
+			}
+		}
 		config := gitlab.ConfigExecOutput{
-			BuildsDir:         internals.Ptr(path.Join(Config.Job.AllocDataDir, "builds", project_path)),
-			CacheDir:          internals.Ptr(path.Join(Config.Job.AllocDataDir, "cache", project_path)),
-			BuildsDirIsShared: internals.Ptr(false),
+			BuildsDir:         internals.Ptr(builds_dir),
+			CacheDir:          internals.Ptr(cache_dir),
+			BuildsDirIsShared: internals.Ptr(builds_dir_is_shared),
 			JobEnv:            &settings,
 		}
 		return json.NewEncoder(cmd.OutOrStdout()).Encode(config)
 	},
 }
 
+// acquireBuildsSlot locks a free builds slot of the project of the job until
+// the job times out, and returns it with the path of its lock. The lock path is
+// empty when every slot is in use.
+func acquireBuildsSlot(id string) (int, string, error) {
+	response_file, err := readResponseFile()
+	if err != nil {
+		return 0, "", err
+	}
+	ttl, err := jobLifetime(response_file)
+	if err != nil {
+		return 0, "", err
+	}
+
+	nomad, err := newNomad(Config)
+	if err != nil {
+		return 0, "", err
+	}
+	for slot := 0; slot < Config.Job.Builds.Slots; slot++ {
+		lock := Config.Job.Builds.LockPath(Identity.ProjectID, slot)
+		acquired, err := nomad.AcquireLock(lock, id, ttl)
+		if err != nil {
+			return 0, "", fmt.Errorf("cannot lock builds slot %d: %w", slot, err)
+		}
+		if acquired {
+			return slot, lock, nil
+		}
+	}
+	return 0, "", nil
+}
+
 func init() {
 	rootCmd.AddCommand(configCmd)
 }
@@ -7,9 +7,12 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"giruno/config"
 	"giruno/gitlab"
 	"giruno/internals"
 
@@ -38,9 +41,115 @@ else
 fi
 mkdir -p /tmp/giruno
 mkfifo /tmp/giruno/stop_task
-read _ < /tmp/giruno/stop_task
 `
 
+// exec_script_deadline stops the task once the job lifetime is elapsed, in
+// case the cleanup stage never runs (e.g. the runner host died).
+var exec_script_deadline = `(sleep %d; echo > /tmp/giruno/stop_task) &
+`
+
+var exec_script_wait = `read _ < /tmp/giruno/stop_task
+`
+
+const placementReportInterval = 30 * time.Second
+
+// placementReason summarizes why the task groups of a job could not be placed.
+func placementReason(registration *internals.Registration) string {
+	failures := registration.PlacementFailures()
+	if len(failures) == 0 {
+		return "waiting for cluster capacity"
+	}
+	return strings.Join(failures, "; ")
+}
+
+func addTaskEnv(task *api.Task, env map[string]string) {
+	if len(env) == 0 {
+		return
+	}
+	if task.Env == nil {
+		task.Env = map[string]string{}
+	}
+	for key, value := range env {
+		task.Env[key] = value
+	}
+}
+
+// ciVariables returns the CI variables of the job. The variables identifying
+// the job and its project are taken from the job response.
+func ciVariables() map[string]string {
+	variables := map[string]string{}
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if name, ok := strings.CutPrefix(key, "CUSTOM_ENV_"); ok {
+			variables[name] = value
+		}
+	}
+	variables["CI_JOB_ID"] = Identity.JobID
+	variables["CI_PROJECT_ID"] = Identity.ProjectID
+	variables["CI_PROJECT_PATH"] = Identity.ProjectPath
+	variables["CI_PROJECT_NAMESPACE"] = Identity.ProjectNamespace
+	return variables
+}
+
+// completeTemplateJob makes a job parsed from the job template runnable by the
+// following stages: they follow its single allocation and run the build in
+// its job and helper tasks, which must run the exec script. It returns the
+// job and helper tasks.
+func completeTemplateJob(job *api.Job, id string, exec_script *api.Template) (*api.Task, *api.Task, error) {
+	if len(job.TaskGroups) != 1 {
+		return nil, nil, fmt.Errorf("the job template must define exactly one task group")
+	}
+	job.ID = &id
+	job.Name = &id
+
+	var job_task, helper_task *api.Task
+	for _, task := range job.TaskGroups[0].Tasks {
+		switch task.Name {
+		case "job":
+			job_task = task
+		case "helper":
+			helper_task = task
+		}
+	}
+	if job_task == nil || helper_task == nil {
+		return nil, nil, fmt.Errorf("the job template must define a 'job' and a 'helper' task")
+	}
+	job_task.Templates = append(job_task.Templates, exec_script)
+	helper_task.Templates = append(helper_task.Templates, exec_script)
+	return job_task, helper_task, nil
+}
+
+// applyTemplateTaskTypes applies the task types to the tasks of the job
+// template named after them: the job and helper tasks, and the service tasks.
+// The task types are optional with a job template.
+func applyTemplateTaskTypes(job *api.Job, service_task_names []string, lookup func(string) (string, bool)) error {
+	task_types := map[string]string{"job": "job", "helper": "helper"}
+	for _, name := range service_task_names {
+		task_types[name] = "service"
+	}
+	for _, task := range job.TaskGroups[0].Tasks {
+		type_name, ok := task_types[task.Name]
+		if !ok {
+			continue
+		}
+		task_type, err := Config.Job.GetTaskType(type_name)
+		if err != nil {
+			continue
+		}
+		err = task_type.ApplyJobSettings(task, lookup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logPlacementFailures(registration *internals.Registration) {
+	for _, failure := range registration.PlacementFailures() {
+		log.Println("Placement failed for " + failure)
+	}
+}
+
 var prepareCmd = &cobra.Command{
 	Use:          "prepare",
 	Args:         cobra.NoArgs,
@@ -51,15 +160,9 @@ var prepareCmd = &cobra.Command{
 			return fmt.Errorf("no JOB_ENV_ID set")
 		}
 
-		response_file_path := os.Getenv("JOB_RESPONSE_FILE")
-		response_file_b, err := os.ReadFile(response_file_path)
+		response_file, err := readResponseFile()
 		if err != nil {
-			return fmt.Errorf("cannot read JOB_RESPONSE_FILE: %w", err)
-		}
-		response_file := map[string]json.RawMessage{}
-		err = json.Unmarshal(response_file_b, &response_file)
-		if err != nil {
-			return fmt.Errorf("cannot unmarshal JOB_RESPONSE_FILE: %w", err)
+			return err
 		}
 
 		// Extract job parameters from GitLab Runner-provided environment.
@@ -69,9 +172,15 @@ var prepareCmd = &cobra.Command{
 			image = Config.DefaultImage
 		}
 
+		// The response file carries the full service definitions, the
+		// environment only their name, alias, entrypoint and command.
 		services := []gitlab.JobService{}
-		env_services := os.Getenv("CUSTOM_ENV_CI_JOB_SERVICES")
-		if env_services != "" {
+		if services_raw, ok := response_file["services"]; ok {
+			err := json.Unmarshal(services_raw, &services)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal services data from response file: %w", err)
+			}
+		} else if env_services := os.Getenv("CUSTOM_ENV_CI_JOB_SERVICES"); env_services != "" {
 			err := json.Unmarshal([]byte(env_services), &services)
 			if err != nil {
 				return err
@@ -127,19 +236,68 @@ var prepareCmd = &cobra.Command{
 			}
 		}
 
+		variables := ciVariables()
+		ci_variable := func(name string) (string, bool) {
+			value, ok := variables[name]
+			return value, ok
+		}
+		for _, undeclared := range Config.Job.UndeclaredOverrides(ci_variable) {
+			log.Printf("Ignoring override: %s", undeclared)
+		}
+
+		log.Println("Preparing environment")
+		nomad, err := newNomad(Config)
+		if err != nil {
+			return err
+		}
+
+		c := make(chan os.Signal, 1)
+		go func() {
+			<-c
+			log.Println("Received SIGTERM, exiting")
+			nomad.Cancel()
+		}()
+		signal.Notify(c, syscall.SIGTERM)
+
 		// Create Nomad job specification.
-		// TODO: pull policy ? id_tokens ? secrets ?
+		// Services share the network namespace of the job, they are reachable
+		// through their hostnames resolved to the loopback address.
+		service_task_names := make([]string, len(services))
+		service_hostnames := make([][]string, len(services))
+		extra_hosts := []string{}
+		used_task_names := map[string]bool{"job": true, "helper": true}
+		for i, service := range services {
+			service_hostnames[i] = internals.ServiceHostnames(service.Name, service.Alias)
+			for _, hostname := range service_hostnames[i] {
+				extra_hosts = append(extra_hosts, hostname+":127.0.0.1")
+			}
 
-		command_file_template := api.Template{
-			EmbeddedTmpl: internals.Ptr(exec_script),
-			DestPath:     internals.Ptr("local/exec_script.sh"),
-			Perms:        internals.Ptr("755"),
+			task_name := service.Name
+			if len(service_hostnames[i]) > 0 {
+				task_name = service_hostnames[i][len(service_hostnames[i])-1]
+			}
+			task_name = "service-" + internals.TaskName(task_name)
+			service_task_names[i] = task_name
+			for n := 2; used_task_names[service_task_names[i]]; n++ {
+				service_task_names[i] = fmt.Sprintf("%s-%d", task_name, n)
+			}
+			used_task_names[service_task_names[i]] = true
 		}
 
-		job_task_type, err := Config.Job.GetTaskType("job")
+		// The allocation lives at most for the GitLab job timeout and a grace
+		// period.
+		lifetime, err := jobLifetime(response_file)
 		if err != nil {
 			return err
 		}
+		script := exec_script + fmt.Sprintf(exec_script_deadline, int(lifetime.Seconds())) + exec_script_wait
+
+		command_file_template := api.Template{
+			EmbeddedTmpl: internals.Ptr(script),
+			DestPath:     internals.Ptr("local/exec_script.sh"),
+			Perms:        internals.Ptr("755"),
+		}
+
 		job_task_image_raw, ok := response_file["image"]
 		if !ok {
 			return fmt.Errorf("cannot extract image data from response file")
@@ -150,36 +308,204 @@ var prepareCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("cannot unmarshal image data from response file: %w", err)
 		}
+		job_pull_policy, err := Config.PullPolicy(job_task_image.PullPolicies)
+		if err != nil {
+			return err
+		}
+		job_ports := []api.Port{}
+		job_port_labels := []string{}
+		for _, port := range job_task_image.Ports {
+			label := internals.PortLabel(port)
+			job_ports = append(job_ports, api.Port{
+				Label: label,
+				To:    port.Number,
+			})
+			job_port_labels = append(job_port_labels, label)
+		}
+
+		// Secrets are rendered from Vault by the Nomad client, they never go
+		// through the runner host.
+		secrets := map[string]gitlab.Secret{}
+		if secrets_raw, ok := response_file["secrets"]; ok {
+			err = json.Unmarshal(secrets_raw, &secrets)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal secrets from response file: %w", err)
+			}
+		}
+
+		_, builds_slot := os.LookupEnv("JOB_ENV_BUILDS_LOCK")
+		runner_tags := gitlab.ParseRunnerTags(os.Getenv("CUSTOM_ENV_CI_RUNNER_TAGS"))
+		images := []string{image, Config.HelperImage}
+		for _, service := range services {
+			images = append(images, service.Name)
+		}
+
+		// The job template replaces the job assembled from the task types.
+		if Config.JobTemplate != "" {
+			services_data := make([]map[string]interface{}, len(services))
+			for i, service := range services {
+				service_pull_policy, err := Config.PullPolicy(service.PullPolicies)
+				if err != nil {
+					return err
+				}
+				services_data[i] = map[string]interface{}{
+					"Service":    service,
+					"TaskName":   service_task_names[i],
+					"Hostnames":  service_hostnames[i],
+					"Variables":  gitlab.Env(service.Variables),
+					"Ports":      service.Ports,
+					"Auth":       registry_auths[internals.DockerImageDomain(service.Name)],
+					"PullPolicy": service_pull_policy,
+					"ForcePull":  service_pull_policy == config.PullPolicyAlways,
+				}
+			}
+			helper_pull_policy, err := Config.PullPolicy(nil)
+			if err != nil {
+				return err
+			}
+			job_hcl, err := Config.RenderJobTemplate(map[string]interface{}{
+				"ID":               id,
+				"Namespace":        Config.Nomad.Namespace,
+				"Datacenters":      Config.Job.Datacenters,
+				"Image":            image,
+				"Entrypoint":       job_task_image.Entrypoint,
+				"ImageVariables":   gitlab.Env(job_task_image.Variables),
+				"Ports":            job_task_image.Ports,
+				"PortLabels":       job_port_labels,
+				"Auth":             registry_auths[internals.DockerImageDomain(image)],
+				"PullPolicy":       job_pull_policy,
+				"ForcePull":        job_pull_policy == config.PullPolicyAlways,
+				"HelperImage":      Config.HelperImage,
+				"HelperAuth":       registry_auths[internals.DockerImageDomain(Config.HelperImage)],
+				"HelperPullPolicy": helper_pull_policy,
+				"HelperForcePull":  helper_pull_policy == config.PullPolicyAlways,
+				"Services":         services_data,
+				"Auths":            registry_auths,
+				"Variables":        variables,
+				"ExtraHosts":       extra_hosts,
+				"ExecScript":       "${NOMAD_TASK_DIR}/exec_script.sh",
+				"Volumes":          Config.Job.Volumes(builds_slot),
+			})
+			if err != nil {
+				return fmt.Errorf("cannot render job template: %w", err)
+			}
+			job_spec, err := nomad.ParseJob(job_hcl)
+			if err != nil {
+				return fmt.Errorf("cannot parse job template: %w", err)
+			}
+			job_task, helper_task, err := completeTemplateJob(job_spec, id, &command_file_template)
+			if err != nil {
+				return err
+			}
+			Config.Job.MountVolumes(job_spec.TaskGroups[0], builds_slot, job_task, helper_task)
+			err = applyTemplateTaskTypes(job_spec, service_task_names, ci_variable)
+			if err != nil {
+				return err
+			}
+			if len(secrets) > 0 {
+				if job_task.Vault == nil {
+					job_task.Vault = Config.Job.Vault
+				}
+				if job_task.Vault == nil {
+					return fmt.Errorf("the job requests secrets but the job task has no vault block")
+				}
+				templates, env, err := internals.SecretTemplates(secrets)
+				if err != nil {
+					return err
+				}
+				job_task.Templates = append(job_task.Templates, templates...)
+				addTaskEnv(job_task, env)
+			}
+			// The datacenters of the tags restrict the overridden datacenter.
+			err = Config.Job.ApplyOverrides(job_spec, ci_variable)
+			if err != nil {
+				return err
+			}
+			err = Config.Job.ApplyTags(job_spec, runner_tags)
+			if err != nil {
+				return err
+			}
+			return submitJob(nomad, id, job_spec, images)
+		}
+
+		job_task_type, err := Config.Job.GetTaskType("job")
+		if err != nil {
+			return err
+		}
 		job_task, err := job_task_type.CreateNomadTask(map[string]interface{}{
 			"Image":      image,
 			"Entrypoint": job_task_image.Entrypoint,
+			"Variables":  gitlab.Env(job_task_image.Variables),
+			"Ports":      job_task_image.Ports,
+			"PortLabels": job_port_labels,
 			"ExecScript": "${NOMAD_TASK_DIR}/exec_script.sh",
 			"Auth":       registry_auths[internals.DockerImageDomain(image)],
+			"PullPolicy": job_pull_policy,
+			"ForcePull":  job_pull_policy == config.PullPolicyAlways,
+			"ExtraHosts": extra_hosts,
 		})
 		if err != nil {
 			return err
 		}
+		err = job_task_type.ApplyJobSettings(job_task, ci_variable)
+		if err != nil {
+			return err
+		}
 		job_task.Name = "job"
 		job_task.Leader = true
+		addTaskEnv(job_task, gitlab.Env(job_task_image.Variables))
 		job_task.Templates = []*api.Template{
 			&command_file_template,
 		}
 
+		if len(secrets) > 0 {
+			if Config.Job.Vault == nil {
+				return fmt.Errorf("the job requests secrets but no vault block is configured")
+			}
+			templates, env, err := internals.SecretTemplates(secrets)
+			if err != nil {
+				return err
+			}
+			job_task.Vault = Config.Job.Vault
+			job_task.Templates = append(job_task.Templates, templates...)
+			addTaskEnv(job_task, env)
+		}
+
 		helper_task_type, err := Config.Job.GetTaskType("helper")
 		if err != nil {
 			return err
 		}
-		helper_task, err := helper_task_type.CreateNomadTask(map[string]interface{}{
-			"Image":      Config.HelperImage,
-			"ExecScript": "${NOMAD_TASK_DIR}/exec_script.sh",
-			"Auth":       registry_auths[internals.DockerImageDomain(Config.HelperImage)],
-		})
+		helper_pull_policy, err := Config.PullPolicy(nil)
 		if err != nil {
 			return err
 		}
-		helper_task.Name = "helper"
-		helper_task.Templates = []*api.Template{
-			&command_file_template,
+		// The helper image also runs the exec script in the task keeping the
+		// separate service groups alive.
+		new_helper_task := func(name string) (*api.Task, error) {
+			task, err := helper_task_type.CreateNomadTask(map[string]interface{}{
+				"Image":      Config.HelperImage,
+				"ExecScript": "${NOMAD_TASK_DIR}/exec_script.sh",
+				"Auth":       registry_auths[internals.DockerImageDomain(Config.HelperImage)],
+				"PullPolicy": helper_pull_policy,
+				"ForcePull":  helper_pull_policy == config.PullPolicyAlways,
+				"ExtraHosts": extra_hosts,
+			})
+			if err != nil {
+				return nil, err
+			}
+			err = helper_task_type.ApplyJobSettings(task, ci_variable)
+			if err != nil {
+				return nil, err
+			}
+			task.Name = name
+			task.Templates = []*api.Template{
+				&command_file_template,
+			}
+			return task, nil
+		}
+		helper_task, err := new_helper_task("helper")
+		if err != nil {
+			return err
 		}
 
 		job_spec := api.Job{
@@ -204,37 +530,121 @@ var prepareCmd = &cobra.Command{
 			},
 		}
 
+		Config.Job.MountVolumes(job_spec.TaskGroups[0], builds_slot, job_task, helper_task)
+
+		// The datacenters of the tags restrict the overridden datacenter.
+		err = Config.Job.ApplyOverrides(&job_spec, ci_variable)
+		if err != nil {
+			return err
+		}
+		err = Config.Job.ApplyTags(&job_spec, runner_tags)
+		if err != nil {
+			return err
+		}
+
 		// Add additionnal tasks for each CI service.
 		service_task_type, err := Config.Job.GetTaskType("service")
 		if err != nil {
 			return err
 		}
-		for _, service := range services {
+		upstreams := Config.Job.ConsulUpstreams()
+		bound_ports := map[int]bool{}
+		for _, upstream := range upstreams {
+			bound_ports[upstream.LocalBindPort] = true
+		}
+		colocated_services := false
+		for i, service := range services {
+			service_pull_policy, err := Config.PullPolicy(service.PullPolicies)
+			if err != nil {
+				return err
+			}
 			task, err := service_task_type.CreateNomadTask(map[string]interface{}{
-				"Service": service,
-				"Auth":    registry_auths[internals.DockerImageDomain(service.Name)],
+				"Service":    service,
+				"Hostnames":  service_hostnames[i],
+				"Variables":  gitlab.Env(service.Variables),
+				"Ports":      service.Ports,
+				"Auth":       registry_auths[internals.DockerImageDomain(service.Name)],
+				"PullPolicy": service_pull_policy,
+				"ForcePull":  service_pull_policy == config.PullPolicyAlways,
 			})
 			if err != nil {
 				return err
 			}
-			task.Name = service.Name
+			err = service_task_type.ApplyJobSettings(task, ci_variable)
+			if err != nil {
+				return err
+			}
+			task.Name = service_task_names[i]
+			addTaskEnv(task, gitlab.Env(service.Variables))
 
-			job_spec.TaskGroups[0].AddTask(task)
-		}
+			if !service_task_type.SeparateGroup {
+				job_spec.TaskGroups[0].AddTask(task)
+				colocated_services = true
+				continue
+			}
 
-		if len(Config.Job.Upstreams) > 0 {
-			job_spec.TaskGroups[0].Networks = []*api.NetworkResource{
-				{
-					Mode: "bridge",
+			// The ports of the service are bound on the loopback address of
+			// the job by Consul Connect upstreams, so that its hostnames keep
+			// resolving to it.
+			if len(service.Ports) == 0 {
+				return fmt.Errorf("service '%s' must expose its ports to run in a separate task group", service.Name)
+			}
+			// The group stops with its leader, which runs the exec script
+			// like the job task so that it shares its deadline.
+			keepalive_task, err := new_helper_task("keepalive")
+			if err != nil {
+				return err
+			}
+			keepalive_task.Leader = true
+			group := &api.TaskGroup{
+				Name:             &task.Name,
+				RestartPolicy:    job_spec.TaskGroups[0].RestartPolicy,
+				ReschedulePolicy: job_spec.TaskGroups[0].ReschedulePolicy,
+				Networks: []*api.NetworkResource{
+					{Mode: "bridge"},
 				},
+				Tasks: []*api.Task{keepalive_task, task},
+			}
+			for _, port := range service.Ports {
+				if bound_ports[port.Number] {
+					return fmt.Errorf("port %d of service '%s' is already bound in the job network", port.Number, service.Name)
+				}
+				bound_ports[port.Number] = true
+				name := internals.ConsulServiceName(id, task.Name, port.Number)
+				group.Services = append(group.Services, &api.Service{
+					Name:      name,
+					PortLabel: strconv.Itoa(port.Number),
+					Connect: &api.ConsulConnect{
+						SidecarService: &api.ConsulSidecarService{},
+					},
+				})
+				upstreams = append(upstreams, &api.ConsulUpstream{
+					DestinationName: name,
+					LocalBindPort:   port.Number,
+				})
 			}
+			job_spec.AddTaskGroup(group)
+		}
+
+		// The tasks of a group only share a network namespace in bridge mode,
+		// which the services reached on the loopback address rely on.
+		if len(upstreams) > 0 || len(job_ports) > 0 || colocated_services {
+			network := &api.NetworkResource{
+				DynamicPorts: job_ports,
+			}
+			if len(upstreams) > 0 || colocated_services {
+				network.Mode = "bridge"
+			}
+			job_spec.TaskGroups[0].Networks = []*api.NetworkResource{network}
+		}
 
+		if len(upstreams) > 0 {
 			job_spec.TaskGroups[0].Services = []*api.Service{
 				{
 					Connect: &api.ConsulConnect{
 						SidecarService: &api.ConsulSidecarService{
 							Proxy: &api.ConsulProxy{
-								Upstreams: Config.Job.ConsulUpstreams(),
+								Upstreams: upstreams,
 							},
 						},
 					},
@@ -242,42 +652,99 @@ var prepareCmd = &cobra.Command{
 			}
 		}
 
-		log.Println("Preparing environment")
-		nomad, err := internals.NewNomad(Config)
+		return submitJob(nomad, id, &job_spec, images)
+	},
+}
+
+// submitJob registers the job and waits for its allocation to run.
+func submitJob(nomad internals.NomadClient, id string, job_spec *api.Job, images []string) error {
+	// The job prefers the node the last job of the project and branch ran on,
+	// to reuse its Docker layers and builds directories.
+	sticky_node_path := ""
+	if Config.Job.StickyNodeWeight > 0 {
+		sticky_node_path = fmt.Sprintf("giruno/nodes/%s/%s",
+			Identity.ProjectID,
+			os.Getenv("CUSTOM_ENV_CI_COMMIT_REF_SLUG"))
+		items, err := nomad.GetVariable(Config.RunnerNamespace(), sticky_node_path)
 		if err != nil {
-			return err
+			log.Printf("Cannot read the last node of the project: %v", err)
+		} else if node := items["node"]; node != "" {
+			job_spec.AddAffinity(api.NewAffinity("${node.unique.id}", "=", node, int8(Config.Job.StickyNodeWeight)))
 		}
-
-		c := make(chan os.Signal, 1)
-		go func() {
-			<-c
-			log.Println("Received SIGTERM, exiting")
-			nomad.Cancel()
-		}()
-		signal.Notify(c, syscall.SIGTERM)
-
-		log.Println("Validating job")
-		err = nomad.ValidateJob(&job_spec)
+	}
+	// The job prefers the nodes which recently ran its images, to save their
+	// pull.
+	if Config.Job.ImageLocalityWeight > 0 {
+		affinities, err := internals.ImageAffinities(nomad, Config.RunnerNamespace(), images,
+			Config.Job.GetImageLocalityWindow(), int8(Config.Job.ImageLocalityWeight))
 		if err != nil {
-			return err
+			log.Printf("Cannot read the nodes of the job images: %v", err)
+		}
+		for _, affinity := range affinities {
+			job_spec.AddAffinity(affinity)
 		}
+	}
 
-		log.Println("Registering job")
-		err = nomad.RegisterJob(&job_spec)
+	log.Println("Validating job")
+	err := nomad.ValidateJob(job_spec)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Registering job")
+	registration, err := nomad.RegisterJob(job_spec)
+	if err != nil {
+		return err
+	}
+	placement_timeout := Config.Job.GetPlacementTimeout()
+	if registration.Status == internals.RegistrationBlocked && placement_timeout > 0 {
+		log.Printf("Job is queued, waiting up to %s for placement: %s", placement_timeout, placementReason(registration))
+		registration, err = nomad.WaitForPlacement(registration, placement_timeout, placementReportInterval,
+			func(elapsed time.Duration, registration *internals.Registration) {
+				log.Printf("Job queued for %s: %s", elapsed.Round(time.Second), placementReason(registration))
+			})
 		if err != nil {
+			if registration != nil {
+				logPlacementFailures(registration)
+			}
 			return err
 		}
+	}
+	if registration.Status != internals.RegistrationPlaced {
+		logPlacementFailures(registration)
+	}
+	switch registration.Status {
+	case internals.RegistrationBlocked:
+		return fmt.Errorf("job placement is blocked")
+	case internals.RegistrationFailed:
+		return fmt.Errorf("job evaluation failed: %s", registration.Description)
+	}
 
-		log.Println("Waiting for job allocation")
-		_, dead, err := nomad.WaitForAllocation(id)
-		if dead {
-			return fmt.Errorf("allocation is dead")
+	log.Println("Waiting for job allocation")
+	alloc, dead, err := nomad.WaitForAllocation(id)
+	if dead {
+		return fmt.Errorf("allocation is dead")
+	}
+	if err != nil {
+		return err
+	}
+
+	if sticky_node_path != "" {
+		err = nomad.PutVariable(Config.RunnerNamespace(), sticky_node_path, api.VariableItems{
+			"node": alloc.NodeID,
+		})
+		if err != nil {
+			log.Printf("Cannot record the node of the job: %v", err)
 		}
+	}
+	if Config.Job.ImageLocalityWeight > 0 {
+		err = internals.RecordImageNode(nomad, Config.RunnerNamespace(), images, alloc.NodeID,
+			Config.Job.GetImageLocalityWindow())
 		if err != nil {
-			return err
+			log.Printf("Cannot record the node of the job images: %v", err)
 		}
-		return nil
-	},
+	}
+	return nil
 }
 
 func init() {
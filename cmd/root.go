@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
 	"giruno/config"
 	"giruno/gitlab"
+	"giruno/internals"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -14,6 +18,16 @@ var cfgFile string
 
 var Config config.Config
 
+// Identity identifies the job and its project, the stages must not trust the
+// CI variables for it as the job can override them.
+var Identity gitlab.JobIdentity
+
+// newNomad creates the Nomad client used by the stages, it can be replaced to
+// run the stages against another implementation.
+var newNomad = func(c config.Config) (internals.NomadClient, error) {
+	return internals.NewNomad(c)
+}
+
 var rootCmd = &cobra.Command{
 	Use: "giruno",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
@@ -24,10 +38,82 @@ var rootCmd = &cobra.Command{
 			return err
 		}
 		Config.WithEnv()
+
+		response_file, err := readResponseFile()
+		if err != nil {
+			return err
+		}
+		Identity, err = gitlab.ParseJobIdentity(response_file)
+		if err != nil {
+			return err
+		}
+
+		// The cluster is selected by the config stage, the following stages
+		// must use the same one.
+		cluster, ok := os.LookupEnv("JOB_ENV_NOMAD_CLUSTER")
+		if !ok {
+			cluster = Config.Nomad.Name
+		}
+		err = useCluster(cluster)
+		if err != nil {
+			return err
+		}
+		// The token obtained by the config stage with the job JWT replaces the
+		// runner token.
+		if token, ok := os.LookupEnv("JOB_ENV_NOMAD_TOKEN"); ok {
+			Config.Nomad.Token = token
+		}
 		return nil
 	},
 }
 
+// useCluster makes the stage use a Nomad cluster, in the namespace mapped to
+// the project of the job.
+func useCluster(name string) error {
+	err := Config.UseCluster(name)
+	if err != nil {
+		return err
+	}
+	Config.Nomad.Namespace = Config.Nomad.ProjectNamespace(Identity.ProjectPath, Identity.ProjectNamespace)
+	return nil
+}
+
+// readResponseFile reads the job response written by GitLab Runner.
+func readResponseFile() (map[string]json.RawMessage, error) {
+	response_file_b, err := os.ReadFile(os.Getenv("JOB_RESPONSE_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read JOB_RESPONSE_FILE: %w", err)
+	}
+	response_file := map[string]json.RawMessage{}
+	err = json.Unmarshal(response_file_b, &response_file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal JOB_RESPONSE_FILE: %w", err)
+	}
+	return response_file, nil
+}
+
+// defaultJobTimeout is the default timeout of GitLab jobs, for job responses
+// without runner info.
+const defaultJobTimeout = 3600
+
+// jobLifetime returns how long the job can run: the job timeout of the job
+// response and the grace period. The CI_JOB_TIMEOUT variable is not used as the
+// job can override it.
+func jobLifetime(response_file map[string]json.RawMessage) (time.Duration, error) {
+	runner_info := gitlab.RunnerInfo{}
+	if runner_info_raw, ok := response_file["runner_info"]; ok {
+		err := json.Unmarshal(runner_info_raw, &runner_info)
+		if err != nil {
+			return 0, fmt.Errorf("cannot unmarshal runner info from response file: %w", err)
+		}
+	}
+	job_timeout := runner_info.Timeout
+	if job_timeout <= 0 {
+		job_timeout = defaultJobTimeout
+	}
+	return time.Duration(job_timeout)*time.Second + Config.Job.GetTimeoutGracePeriod(), nil
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 	"giruno/gitlab"
-	"giruno/internals"
 	"log"
 	"os"
 	"os/signal"
@@ -47,7 +46,7 @@ var runCmd = &cobra.Command{
 		}*/
 
 		log.Printf("Running stage '%s'", stage)
-		nomad, err := internals.NewNomad(Config)
+		nomad, err := newNomad(Config)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// buildsVolumeName is the name of the builds volume in the job task group.
+const buildsVolumeName = "builds"
+
+// JobBuilds is a host volume holding the builds directories, so that they are
+// reused by the following jobs of a project. Each project has a number of
+// slots, a job holds the lock of a slot while it uses its directory.
+type JobBuilds struct {
+	Source      string `hcl:"source"`
+	Destination string `hcl:"destination,optional"`
+	Slots       int    `hcl:"slots,optional"`
+}
+
+func (b *JobBuilds) validate() error {
+	if b.Destination == "" {
+		b.Destination = "/builds"
+	}
+	if !path.IsAbs(b.Destination) {
+		return fmt.Errorf("builds destination '%s' is not an absolute path", b.Destination)
+	}
+	if b.Slots == 0 {
+		b.Slots = 1
+	}
+	if b.Slots < 0 {
+		return fmt.Errorf("invalid number of builds slots %d", b.Slots)
+	}
+	return nil
+}
+
+// LockPath returns the path of the Nomad variable locking a slot of a
+// project.
+func (b *JobBuilds) LockPath(project_id string, slot int) string {
+	return fmt.Sprintf("giruno/builds/%s/%d", project_id, slot)
+}
+
+// Dir returns the builds directory of a slot of a project in the tasks.
+func (b *JobBuilds) Dir(project_path string, slot int) string {
+	return path.Join(b.Destination, project_path, strconv.Itoa(slot))
+}
+
+// Mount adds the builds volume to a task group and mounts it in its tasks.
+func (b *JobBuilds) Mount(group *api.TaskGroup, tasks ...*api.Task) {
+	mountVolume(group, &api.VolumeRequest{
+		Name:   buildsVolumeName,
+		Type:   "host",
+		Source: b.Source,
+	}, b.Destination, tasks)
+}
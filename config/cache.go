@@ -0,0 +1,133 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	CacheVolumeHost = "host"
+	CacheVolumeCSI  = "csi"
+)
+
+// cacheVolumeName is the name of the cache volume in the job task group.
+const cacheVolumeName = "cache"
+
+// JobCache is a persistent volume holding the GitLab cache of the jobs, in a
+// directory per key. The cache archives are written to a temporary file and
+// renamed by GitLab Runner, so concurrent jobs can share a key.
+type JobCache struct {
+	Type           string `hcl:"type"`
+	Source         string `hcl:"source"`
+	AccessMode     string `hcl:"access_mode,optional"`
+	AttachmentMode string `hcl:"attachment_mode,optional"`
+	Destination    string `hcl:"destination,optional"`
+	// Key is a template of the cache directory in the volume, rendered with
+	// the CI variables of the job. Only CI_JOB_ID and CI_PROJECT_* are
+	// trusted, the job can set the other variables.
+	Key string `hcl:"key,optional"`
+
+	key *template.Template
+}
+
+func (c *JobCache) validate() error {
+	switch c.Type {
+	case CacheVolumeHost:
+	case CacheVolumeCSI:
+		if c.AccessMode == "" {
+			c.AccessMode = "multi-node-multi-writer"
+		}
+		if c.AttachmentMode == "" {
+			c.AttachmentMode = "file-system"
+		}
+	default:
+		return fmt.Errorf("invalid cache volume type '%s'", c.Type)
+	}
+	if c.Destination == "" {
+		c.Destination = "/cache"
+	}
+	if !path.IsAbs(c.Destination) {
+		return fmt.Errorf("cache destination '%s' is not an absolute path", c.Destination)
+	}
+	if c.Key == "" {
+		c.Key = "{{.CI_PROJECT_PATH}}"
+	}
+	var err error
+	c.key, err = template.New("cache_key").Funcs(templateFuncs).Parse(c.Key)
+	if err != nil {
+		return fmt.Errorf("invalid cache key: %w", err)
+	}
+	return nil
+}
+
+// Dir returns the cache directory of a job in the tasks. Keys with parent
+// directory references are rejected, so that a job cannot reach the directory
+// of another key.
+func (c *JobCache) Dir(variables map[string]string) (string, error) {
+	key := new(bytes.Buffer)
+	err := c.key.Execute(key, variables)
+	if err != nil {
+		return "", fmt.Errorf("cannot render cache key: %w", err)
+	}
+	for _, segment := range strings.Split(key.String(), "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid cache key '%s'", key.String())
+		}
+	}
+	return path.Join(c.Destination, key.String()), nil
+}
+
+// Mount adds the cache volume to a task group and mounts it in its tasks.
+func (c *JobCache) Mount(group *api.TaskGroup, tasks ...*api.Task) {
+	mountVolume(group, &api.VolumeRequest{
+		Name:           cacheVolumeName,
+		Type:           c.Type,
+		Source:         c.Source,
+		AccessMode:     c.AccessMode,
+		AttachmentMode: c.AttachmentMode,
+	}, c.Destination, tasks)
+}
+
+// Volumes returns the destinations of the volumes mounted in the job and
+// helper tasks by their name: the cache volume, and the builds volume when the
+// job holds a builds slot.
+func (j *Job) Volumes(builds_slot bool) map[string]string {
+	volumes := map[string]string{}
+	if j.Cache != nil {
+		volumes[cacheVolumeName] = j.Cache.Destination
+	}
+	if builds_slot && j.Builds != nil {
+		volumes[buildsVolumeName] = j.Builds.Destination
+	}
+	return volumes
+}
+
+// MountVolumes adds the volumes returned by Volumes to a task group and mounts
+// them in its tasks.
+func (j *Job) MountVolumes(group *api.TaskGroup, builds_slot bool, tasks ...*api.Task) {
+	if j.Cache != nil {
+		j.Cache.Mount(group, tasks...)
+	}
+	if builds_slot && j.Builds != nil {
+		j.Builds.Mount(group, tasks...)
+	}
+}
+
+// mountVolume adds a volume to a task group and mounts it in its tasks.
+func mountVolume(group *api.TaskGroup, volume *api.VolumeRequest, destination string, tasks []*api.Task) {
+	if group.Volumes == nil {
+		group.Volumes = map[string]*api.VolumeRequest{}
+	}
+	group.Volumes[volume.Name] = volume
+	for _, task := range tasks {
+		task.VolumeMounts = append(task.VolumeMounts, &api.VolumeMount{
+			Volume:      &volume.Name,
+			Destination: &destination,
+		})
+	}
+}
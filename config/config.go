@@ -2,9 +2,16 @@ package config
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"text/template"
+	"time"
 
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/v2/hclsimple"
@@ -13,26 +20,110 @@ import (
 	"github.com/zclconf/go-cty/cty/gocty"
 )
 
+const (
+	// ClusterSelectionFailover selects the healthy cluster with the highest
+	// priority.
+	ClusterSelectionFailover = "failover"
+	// ClusterSelectionLeastLoaded selects the healthy cluster with the most
+	// free capacity.
+	ClusterSelectionLeastLoaded = "least_loaded"
+)
+
+const (
+	PullPolicyAlways       = "always"
+	PullPolicyIfNotPresent = "if-not-present"
+	PullPolicyNever        = "never"
+)
+
+// errPullPolicyNever is returned for the never pull policy: the Nomad docker
+// driver pulls missing images, it cannot fail the job instead.
+var errPullPolicyNever = errors.New("pull policy 'never' is not supported by the Nomad docker driver, which always pulls missing images")
+
 type Config struct {
-	Nomad        Nomad  `hcl:"nomad,block"`
-	DefaultImage string `hcl:"image"`
-	HelperImage  string `hcl:"helper_image"`
-	Job          Job    `hcl:"job,block"`
+	Clusters            []*Nomad `hcl:"nomad,block"`
+	ClusterSelection    string   `hcl:"cluster_selection,optional"`
+	DefaultImage        string   `hcl:"image"`
+	HelperImage         string   `hcl:"helper_image"`
+	PullPolicies        []string `hcl:"pull_policy,optional"`
+	AllowedPullPolicies []string `hcl:"allowed_pull_policies,optional"`
+	// JobTemplate is a complete Nomad HCL2 jobspec used instead of the job
+	// assembled from the task types, see RenderJobTemplate.
+	JobTemplate     string `hcl:"job_template,optional"`
+	JobTemplateFile string `hcl:"job_template_file,optional"`
+	Job             Job    `hcl:"job,block"`
+
+	// Nomad is the cluster the job runs on, see UseCluster.
+	Nomad Nomad
 }
 
 type Nomad struct {
-	Address   string `hcl:"address"`
-	Token     string `hcl:"token,optional"`
-	TokenFile string `hcl:"token_file,optional"`
-	Region    string `hcl:"region,optional"`
+	Name          string `hcl:"name,optional"`
+	Priority      int    `hcl:"priority,optional"`
+	Address       string `hcl:"address"`
+	Token         string `hcl:"token,optional"`
+	TokenFile     string `hcl:"token_file,optional"`
+	Region        string `hcl:"region,optional"`
+	Namespace     string `hcl:"namespace"`
+	CACert        string `hcl:"ca_cert,optional"`
+	CAPath        string `hcl:"ca_path,optional"`
+	ClientCert    string `hcl:"client_cert,optional"`
+	ClientKey     string `hcl:"client_key,optional"`
+	TLSServerName string `hcl:"tls_server_name,optional"`
+	TLSSkipVerify bool   `hcl:"tls_skip_verify,optional"`
+	// AuthMethod is the Nomad JWT auth method used to exchange the GitLab job
+	// JWT for a short-lived ACL token instead of using Token.
+	AuthMethod      string `hcl:"auth_method,optional"`
+	AuthJWTVariable string `hcl:"auth_jwt_variable,optional"`
+	// NamespaceRules map GitLab projects to Nomad namespaces, the first
+	// matching rule wins and Namespace is the default.
+	NamespaceRules []*NamespaceRule `hcl:"namespace_rule,block"`
+}
+
+// NamespaceRule matches a GitLab project by the glob of its path, the glob of
+// its group path or a regular expression on its path.
+type NamespaceRule struct {
 	Namespace string `hcl:"namespace"`
+	Project   string `hcl:"project,optional"`
+	Group     string `hcl:"group,optional"`
+	Regex     string `hcl:"regex,optional"`
+
+	regex *regexp.Regexp
 }
 
 type Job struct {
-	Datacenters  []string       `hcl:"datacenters"`
-	AllocDataDir string         `hcl:"alloc_data_dir"`
-	Upstreams    []*JobUpstream `hcl:"upstreams,block"`
-	TaskTypes    []*TaskType    `hcl:"task,block"`
+	Datacenters      []string       `hcl:"datacenters"`
+	AllocDataDir     string         `hcl:"alloc_data_dir"`
+	PlacementTimeout string         `hcl:"placement_timeout,optional"`
+	TimeoutGrace     string         `hcl:"timeout_grace_period,optional"`
+	Upstreams        []*JobUpstream `hcl:"upstreams,block"`
+	Overrides        []*Override    `hcl:"override,block"`
+	Tags             []*JobTag      `hcl:"tag,block"`
+	// Vault is the vault block of the job task when the CI job has secrets,
+	// its role and namespace select the Vault token the secrets are read with.
+	Vault  *api.Vault `hcl:"vault,block"`
+	Cache  *JobCache  `hcl:"cache,block"`
+	Builds *JobBuilds `hcl:"builds,block"`
+	// StickyNodeWeight is the weight of the affinity to the node the last job
+	// of the same project and branch ran on, zero disables it.
+	StickyNodeWeight int `hcl:"sticky_node_weight,optional"`
+	// ImageLocalityWeight is the weight of the affinity to the nodes which ran
+	// the images of the job within ImageLocalityWindow, zero disables it.
+	ImageLocalityWeight int         `hcl:"image_locality_weight,optional"`
+	ImageLocalityWindow string      `hcl:"image_locality_window,optional"`
+	TaskTypes           []*TaskType `hcl:"task,block"`
+
+	placementTimeout    time.Duration
+	timeoutGrace        time.Duration
+	imageLocalityWindow time.Duration
+}
+
+// JobTag maps a GitLab runner tag of the CI job to placement rules.
+type JobTag struct {
+	Name        string            `hcl:"name,label"`
+	Datacenters []string          `hcl:"datacenters,optional"`
+	NodePool    string            `hcl:"node_pool,optional"`
+	Constraints []*api.Constraint `hcl:"constraint,block"`
+	Affinities  []*api.Affinity   `hcl:"affinity,block"`
 }
 
 type JobUpstream struct {
@@ -54,6 +145,14 @@ type TaskType struct {
 	Affinities     []*api.Affinity   `hcl:"affinity,block"`
 	Resources      *api.Resources    `hcl:"resources,block"`
 	Meta           map[string]string `hcl:"meta,optional"`
+	Overrides      []*Override       `hcl:"override,block"`
+	// Identities are the Nomad workload identities requested for the tasks of
+	// this type, see TaskIdentity.
+	Identities []*TaskIdentity `hcl:"identity,block"`
+	// SeparateGroup places each service in its own task group, so that it can
+	// run on another node than the job, which reaches it through Consul
+	// Connect.
+	SeparateGroup bool `hcl:"separate_group,optional"`
 }
 
 func FromFile(path string) (Config, error) {
@@ -63,32 +162,384 @@ func FromFile(path string) (Config, error) {
 		return config, err
 	}
 
-	if config.Nomad.TokenFile != "" {
-		token, err := os.ReadFile(config.Nomad.TokenFile)
+	if len(config.Clusters) == 0 {
+		return config, fmt.Errorf("at least one nomad block is required")
+	}
+	names := map[string]bool{}
+	for _, cluster := range config.Clusters {
+		if cluster.Name == "" {
+			cluster.Name = cluster.Address
+		}
+		if names[cluster.Name] {
+			return config, fmt.Errorf("duplicate nomad cluster name '%s'", cluster.Name)
+		}
+		names[cluster.Name] = true
+
+		if cluster.TokenFile != "" {
+			token, err := os.ReadFile(cluster.TokenFile)
+			if err != nil {
+				return config, err
+			}
+			cluster.Token = string(token)
+		}
+
+		if cluster.AuthJWTVariable == "" {
+			cluster.AuthJWTVariable = "CI_JOB_JWT"
+		}
+
+		for _, rule := range cluster.NamespaceRules {
+			err = rule.compile()
+			if err != nil {
+				return config, fmt.Errorf("invalid namespace rule for cluster '%s': %w", cluster.Name, err)
+			}
+		}
+
+		err = cluster.validateTLS()
+		if err != nil {
+			return config, fmt.Errorf("invalid nomad TLS configuration for cluster '%s': %w", cluster.Name, err)
+		}
+	}
+	sort.SliceStable(config.Clusters, func(i, j int) bool {
+		return config.Clusters[i].Priority > config.Clusters[j].Priority
+	})
+	config.Nomad = *config.Clusters[0]
+
+	switch config.ClusterSelection {
+	case "":
+		config.ClusterSelection = ClusterSelectionFailover
+	case ClusterSelectionFailover, ClusterSelectionLeastLoaded:
+	default:
+		return config, fmt.Errorf("invalid cluster_selection '%s'", config.ClusterSelection)
+	}
+
+	if config.JobTemplateFile != "" {
+		if config.JobTemplate != "" {
+			return config, fmt.Errorf("job_template and job_template_file are mutually exclusive")
+		}
+		job_template, err := os.ReadFile(config.JobTemplateFile)
 		if err != nil {
 			return config, err
 		}
-		config.Nomad.Token = string(token)
+		config.JobTemplate = string(job_template)
+	}
+
+	if len(config.PullPolicies) == 0 {
+		config.PullPolicies = []string{PullPolicyAlways}
+	}
+	if len(config.AllowedPullPolicies) == 0 {
+		config.AllowedPullPolicies = config.PullPolicies
+	}
+	for _, policy := range append(config.PullPolicies, config.AllowedPullPolicies...) {
+		switch policy {
+		case PullPolicyAlways, PullPolicyIfNotPresent:
+		case PullPolicyNever:
+			return config, errPullPolicyNever
+		default:
+			return config, fmt.Errorf("invalid pull policy '%s'", policy)
+		}
+	}
+
+	for _, override := range config.Job.Overrides {
+		err = override.validate(jobOverrides)
+		if err != nil {
+			return config, fmt.Errorf("invalid job override: %w", err)
+		}
+	}
+	for _, task_type := range config.Job.TaskTypes {
+		if task_type.SeparateGroup && task_type.Type != "service" {
+			return config, fmt.Errorf("separate_group is only supported for services, not for task '%s'", task_type.Type)
+		}
+		if task_type.SeparateGroup && config.JobTemplate != "" {
+			return config, fmt.Errorf("separate_group is not supported with a job template, which defines the task groups")
+		}
+		for _, override := range task_type.Overrides {
+			err = override.validate(taskOverrides)
+			if err != nil {
+				return config, fmt.Errorf("invalid override for task '%s': %w", task_type.Type, err)
+			}
+		}
+		for _, identity := range task_type.Identities {
+			err = identity.validate()
+			if err != nil {
+				return config, fmt.Errorf("invalid identity for task '%s': %w", task_type.Type, err)
+			}
+		}
+	}
+
+	if config.Job.PlacementTimeout != "" {
+		config.Job.placementTimeout, err = time.ParseDuration(config.Job.PlacementTimeout)
+		if err != nil {
+			return config, fmt.Errorf("invalid job placement_timeout: %w", err)
+		}
+	}
+	if config.Job.Cache != nil {
+		err = config.Job.Cache.validate()
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.Job.Builds != nil {
+		err = config.Job.Builds.validate()
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.Job.StickyNodeWeight < 0 || config.Job.StickyNodeWeight > 100 {
+		return config, fmt.Errorf("invalid job sticky_node_weight %d, expected a weight between 0 and 100", config.Job.StickyNodeWeight)
+	}
+	if config.Job.ImageLocalityWeight < 0 || config.Job.ImageLocalityWeight > 100 {
+		return config, fmt.Errorf("invalid job image_locality_weight %d, expected a weight between 0 and 100", config.Job.ImageLocalityWeight)
+	}
+	config.Job.imageLocalityWindow = 24 * time.Hour
+	if config.Job.ImageLocalityWindow != "" {
+		config.Job.imageLocalityWindow, err = time.ParseDuration(config.Job.ImageLocalityWindow)
+		if err != nil {
+			return config, fmt.Errorf("invalid job image_locality_window: %w", err)
+		}
+	}
+	config.Job.timeoutGrace = 5 * time.Minute
+	if config.Job.TimeoutGrace != "" {
+		config.Job.timeoutGrace, err = time.ParseDuration(config.Job.TimeoutGrace)
+		if err != nil {
+			return config, fmt.Errorf("invalid job timeout_grace_period: %w", err)
+		}
 	}
 	return config, nil
 }
 
+func (r *NamespaceRule) compile() error {
+	matchers := 0
+	for _, glob := range []string{r.Project, r.Group} {
+		if glob == "" {
+			continue
+		}
+		matchers++
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob '%s': %w", glob, err)
+		}
+	}
+	if r.Regex != "" {
+		matchers++
+		var err error
+		r.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return err
+		}
+	}
+	if matchers != 1 {
+		return fmt.Errorf("exactly one of project, group or regex must be set for namespace '%s'", r.Namespace)
+	}
+	return nil
+}
+
+func (r *NamespaceRule) matches(project_path string, group_path string) bool {
+	switch {
+	case r.Project != "":
+		matched, _ := path.Match(r.Project, project_path)
+		return matched
+	case r.Group != "":
+		matched, _ := path.Match(r.Group, group_path)
+		return matched
+	default:
+		return r.regex.MatchString(project_path)
+	}
+}
+
+// ProjectNamespace returns the namespace of the first namespace rule matching
+// a GitLab project, or the default namespace.
+func (n *Nomad) ProjectNamespace(project_path string, group_path string) string {
+	for _, rule := range n.NamespaceRules {
+		if rule.matches(project_path, group_path) {
+			return rule.Namespace
+		}
+	}
+	return n.Namespace
+}
+
+// validateTLS checks that the TLS files of the nomad block can be loaded.
+func (n *Nomad) validateTLS() error {
+	if (n.ClientCert == "") != (n.ClientKey == "") {
+		return fmt.Errorf("both client_cert and client_key must be provided")
+	}
+	if n.ClientCert != "" {
+		if _, err := tls.LoadX509KeyPair(n.ClientCert, n.ClientKey); err != nil {
+			return err
+		}
+	}
+	if n.CACert != "" {
+		pem, err := os.ReadFile(n.CACert)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca_cert %s", n.CACert)
+		}
+	}
+	if n.CAPath != "" {
+		info, err := os.Stat(n.CAPath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("ca_path %s is not a directory", n.CAPath)
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the TLS settings of the nomad block.
+func (n *Nomad) TLSConfig() *api.TLSConfig {
+	return &api.TLSConfig{
+		CACert:        n.CACert,
+		CAPath:        n.CAPath,
+		ClientCert:    n.ClientCert,
+		ClientKey:     n.ClientKey,
+		TLSServerName: n.TLSServerName,
+		Insecure:      n.TLSSkipVerify,
+	}
+}
+
+// WithEnv overrides the cluster settings with the NOMAD_* environment
+// variables. They describe a single cluster, so they are ignored when several
+// nomad blocks are configured.
 func (c *Config) WithEnv() {
+	if len(c.Clusters) != 1 {
+		return
+	}
+	c.Clusters[0].withEnv()
+	c.Nomad.withEnv()
+}
+
+func (n *Nomad) withEnv() {
 	if v, ok := os.LookupEnv("NOMAD_ADDR"); ok {
-		c.Nomad.Address = v
+		n.Address = v
 	}
 	if v, ok := os.LookupEnv("NOMAD_TOKEN"); ok {
-		c.Nomad.Token = v
+		n.Token = v
 	}
 	if v, ok := os.LookupEnv("NOMAD_TOKEN_FILE"); ok {
-		c.Nomad.TokenFile = v
+		n.TokenFile = v
 	}
 	if v, ok := os.LookupEnv("NOMAD_REGION"); ok {
-		c.Nomad.Region = v
+		n.Region = v
 	}
 	if v, ok := os.LookupEnv("NOMAD_NAMESPACE"); ok {
-		c.Nomad.Namespace = v
+		n.Namespace = v
+	}
+
+	// The TLS settings which are not set are taken from NOMAD_CACERT,
+	// NOMAD_CLIENT_CERT and the like.
+	env_tls := api.DefaultConfig().TLSConfig
+	if n.CACert == "" && n.CAPath == "" {
+		n.CACert, n.CAPath = env_tls.CACert, env_tls.CAPath
+	}
+	if n.ClientCert == "" {
+		n.ClientCert, n.ClientKey = env_tls.ClientCert, env_tls.ClientKey
+	}
+	if n.TLSServerName == "" {
+		n.TLSServerName = env_tls.TLSServerName
+	}
+	n.TLSSkipVerify = n.TLSSkipVerify || env_tls.Insecure
+}
+
+// UseCluster selects the cluster the job runs on by name.
+func (c *Config) UseCluster(name string) error {
+	for _, cluster := range c.Clusters {
+		if cluster.Name == name {
+			c.Nomad = *cluster
+			return nil
+		}
+	}
+	return fmt.Errorf("nomad cluster '%s' not found", name)
+}
+
+// RunnerNamespace returns the namespace configured for the cluster in use,
+// whatever the namespace of the project of the job.
+func (c *Config) RunnerNamespace() string {
+	for _, cluster := range c.Clusters {
+		if cluster.Name == c.Nomad.Name {
+			return cluster.Namespace
+		}
+	}
+	return c.Nomad.Namespace
+}
+
+// PullPolicy returns the pull policy to use for an image given the policies
+// requested by the job, falling back to the runner pull_policy. As with the
+// Docker executor, the policies must be in allowed_pull_policies and the first
+// allowed one is used.
+func (c *Config) PullPolicy(requested []string) (string, error) {
+	policies := requested
+	if len(policies) == 0 {
+		policies = c.PullPolicies
 	}
+	for _, policy := range policies {
+		if policy == PullPolicyNever {
+			return "", errPullPolicyNever
+		}
+		for _, allowed := range c.AllowedPullPolicies {
+			if policy == allowed {
+				return policy, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("pull_policy (%v) defined in GitLab pipeline config is not one of the allowed_pull_policies (%v)", policies, c.AllowedPullPolicies)
+}
+
+// GetPlacementTimeout returns how long prepare waits for a blocked job to be
+// placed. Zero means blocked jobs fail immediately.
+func (j *Job) GetPlacementTimeout() time.Duration {
+	return j.placementTimeout
+}
+
+// ApplyTags adds the placement rules mapped to the tags of the CI job. Tags
+// without mapping are ignored, the datacenters of several tags are
+// intersected and their node pools must agree.
+func (j *Job) ApplyTags(job *api.Job, tags []string) error {
+	for _, tag := range tags {
+		for _, mapping := range j.Tags {
+			if mapping.Name != tag {
+				continue
+			}
+			for _, constraint := range mapping.Constraints {
+				job.Constrain(constraint)
+			}
+			for _, affinity := range mapping.Affinities {
+				job.AddAffinity(affinity)
+			}
+			if len(mapping.Datacenters) > 0 {
+				var datacenters []string
+				for _, datacenter := range job.Datacenters {
+					for _, allowed := range mapping.Datacenters {
+						if datacenter == allowed {
+							datacenters = append(datacenters, datacenter)
+						}
+					}
+				}
+				if len(datacenters) == 0 {
+					return fmt.Errorf("tag '%s' restricts the job to datacenters %v, none of %v", tag, mapping.Datacenters, job.Datacenters)
+				}
+				job.Datacenters = datacenters
+			}
+			if mapping.NodePool != "" {
+				if job.NodePool != nil && *job.NodePool != "" && *job.NodePool != mapping.NodePool {
+					return fmt.Errorf("tag '%s' places the job in node pool '%s', not '%s'", tag, mapping.NodePool, *job.NodePool)
+				}
+				job.NodePool = &mapping.NodePool
+			}
+		}
+	}
+	return nil
+}
+
+// GetTimeoutGracePeriod returns how long an allocation outlives the GitLab job
+// timeout before it stops by itself.
+func (j *Job) GetTimeoutGracePeriod() time.Duration {
+	return j.timeoutGrace
+}
+
+func (j *Job) GetImageLocalityWindow() time.Duration {
+	return j.imageLocalityWindow
 }
 
 func (j *Job) GetTaskType(task_type string) (*TaskType, error) {
@@ -116,29 +567,34 @@ func (j *Job) ConsulUpstreams() []*api.ConsulUpstream {
 	return upstreams
 }
 
+var templateFuncs = template.FuncMap{
+	"deref": func(v *[]string) []string {
+		if v == nil {
+			return nil
+		}
+		return *v
+	},
+	"hcl": func(v interface{}) (string, error) {
+		valTy, err := gocty.ImpliedType(v)
+		if err != nil {
+			return "", err
+		}
+
+		val, err := gocty.ToCtyValue(v, valTy)
+		if err != nil {
+			// This should never happen, since we should always be able
+			// to decode into the implied type.
+			panic(fmt.Sprintf("failed to encode %T as %#v: %s", v, valTy, err))
+		}
+
+		return string(hclwrite.TokensForValue(val).Bytes()), nil
+	},
+}
+
 func (t *TaskType) DriverConfig(task_data map[string]interface{}) (map[string]interface{}, error) {
 	tmpl, err := template.
 		New("driver_config").
-		Funcs(template.FuncMap{
-			"deref": func(v *[]string) []string {
-				return *v
-			},
-			"hcl": func(v interface{}) (string, error) {
-				valTy, err := gocty.ImpliedType(v)
-				if err != nil {
-					return "", err
-				}
-
-				val, err := gocty.ToCtyValue(v, valTy)
-				if err != nil {
-					// This should never happen, since we should always be able
-					// to decode into the implied type.
-					panic(fmt.Sprintf("failed to encode %T as %#v: %s", v, valTy, err))
-				}
-
-				return string(hclwrite.TokensForValue(val).Bytes()), nil
-			},
-		}).
+		Funcs(templateFuncs).
 		Parse(t.ConfigTemplate)
 	if err != nil {
 		return nil, err
@@ -163,3 +619,22 @@ func (t *TaskType) DriverConfig(task_data map[string]interface{}) (map[string]in
 	}
 	return config, nil
 }
+
+// RenderJobTemplate renders the job template with the job context. Its actions
+// are delimited by [[ and ]], so that the jobspec can contain Nomad templates.
+func (c *Config) RenderJobTemplate(job_data map[string]interface{}) (string, error) {
+	tmpl, err := template.
+		New("job_template").
+		Delims("[[", "]]").
+		Funcs(templateFuncs).
+		Parse(c.JobTemplate)
+	if err != nil {
+		return "", err
+	}
+	job_hcl := new(bytes.Buffer)
+	err = tmpl.Execute(job_hcl, job_data)
+	if err != nil {
+		return "", err
+	}
+	return job_hcl.String(), nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import "testing"
+
+func TestProjectNamespace(t *testing.T) {
+	nomad := &Nomad{
+		Namespace: "default",
+		NamespaceRules: []*NamespaceRule{
+			{Namespace: "app", Project: "group/app"},
+			{Namespace: "team", Group: "team-*"},
+			{Namespace: "infra", Regex: `^infra/.*-ci$`},
+			{Namespace: "group", Group: "group"},
+		},
+	}
+	for _, rule := range nomad.NamespaceRules {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		project string
+		group   string
+		want    string
+	}{
+		{"group/app", "group", "app"},
+		{"group/other", "group", "group"},
+		{"team-a/app", "team-a", "team"},
+		{"team-a/sub/app", "team-a/sub", "default"},
+		{"infra/deploy-ci", "infra", "infra"},
+		{"infra/deploy", "infra", "default"},
+		{"other/app", "other", "default"},
+	}
+	for _, test := range tests {
+		t.Run(test.project, func(t *testing.T) {
+			got := nomad.ProjectNamespace(test.project, test.group)
+			if got != test.want {
+				t.Errorf("ProjectNamespace(%q, %q) = %q, want %q", test.project, test.group, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithEnvTLS(t *testing.T) {
+	t.Setenv("NOMAD_CACERT", "/etc/nomad/env-ca.pem")
+	t.Setenv("NOMAD_CLIENT_CERT", "/etc/nomad/env-cert.pem")
+	t.Setenv("NOMAD_CLIENT_KEY", "/etc/nomad/env-key.pem")
+
+	tests := []struct {
+		name     string
+		clusters []*Nomad
+		ca_cert  string
+		cert     string
+	}{
+		{
+			name:     "single cluster",
+			clusters: []*Nomad{{Name: "dc1", CACert: "/etc/nomad/ca.pem"}},
+			ca_cert:  "/etc/nomad/ca.pem",
+			cert:     "/etc/nomad/env-cert.pem",
+		},
+		{
+			name:     "several clusters",
+			clusters: []*Nomad{{Name: "dc1", CACert: "/etc/nomad/ca.pem"}, {Name: "dc2"}},
+			ca_cert:  "/etc/nomad/ca.pem",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Clusters: test.clusters, Nomad: *test.clusters[0]}
+			config.WithEnv()
+			if err := config.UseCluster("dc1"); err != nil {
+				t.Fatal(err)
+			}
+			tls_config := config.Nomad.TLSConfig()
+			if tls_config.CACert != test.ca_cert || tls_config.ClientCert != test.cert {
+				t.Errorf("TLSConfig() = %+v, want ca_cert %q and client_cert %q", tls_config, test.ca_cert, test.cert)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// defaultIdentityName is the name of the identity Nomad gives every task, used
+// to call the Nomad API.
+const defaultIdentityName = "default"
+
+// TaskIdentity is a Nomad workload identity requested for the tasks of a type
+// and written to a file, e.g. to authenticate to cloud providers with OIDC.
+type TaskIdentity struct {
+	Name     string   `hcl:"name,label"`
+	Audience []string `hcl:"aud,optional"`
+	TTL      string   `hcl:"ttl,optional"`
+	// IDToken maps the identity to a GitLab id_token: it is only requested for
+	// the jobs defining this id_token, and the path of its file is set in the
+	// <id_token>_FILE variable.
+	IDToken string `hcl:"id_token,optional"`
+
+	ttl time.Duration
+}
+
+func (i *TaskIdentity) validate() error {
+	if i.Name == defaultIdentityName {
+		if len(i.Audience) > 0 || i.TTL != "" || i.IDToken != "" {
+			return fmt.Errorf("the default identity only supports being written to a file")
+		}
+		return nil
+	}
+	if len(i.Audience) == 0 {
+		return fmt.Errorf("identity '%s' requires an audience", i.Name)
+	}
+	if i.TTL != "" {
+		var err error
+		i.ttl, err = time.ParseDuration(i.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl of identity '%s': %w", i.Name, err)
+		}
+	}
+	return nil
+}
+
+// file returns the path of the identity file in the task, and the variable
+// holding it.
+func (i *TaskIdentity) file() (string, string) {
+	if i.Name == defaultIdentityName {
+		return "${NOMAD_SECRETS_DIR}/nomad_token", "NOMAD_IDENTITY_FILE"
+	}
+	variable := "NOMAD_IDENTITY_FILE_" + i.Name
+	if i.IDToken != "" {
+		variable = i.IDToken + "_FILE"
+	}
+	return "${NOMAD_SECRETS_DIR}/nomad_" + i.Name + ".jwt", variable
+}
+
+// ApplyIdentities requests the workload identities of the task type for a
+// task, unless it already defines them. The identities mapped to an id_token
+// are only requested if the CI job defines it.
+func (t *TaskType) ApplyIdentities(task *api.Task, lookup func(string) (string, bool)) {
+	for _, identity := range t.Identities {
+		if identity.IDToken != "" {
+			if _, ok := lookup(identity.IDToken); !ok {
+				continue
+			}
+		}
+		if taskIdentity(task, identity.Name) != nil {
+			continue
+		}
+
+		workload_identity := &api.WorkloadIdentity{
+			Name:     identity.Name,
+			Audience: identity.Audience,
+			TTL:      identity.ttl,
+			File:     true,
+		}
+		if identity.Name == defaultIdentityName {
+			task.Identity = workload_identity
+		} else {
+			task.Identities = append(task.Identities, workload_identity)
+		}
+		path, variable := identity.file()
+		if task.Env == nil {
+			task.Env = map[string]string{}
+		}
+		task.Env[variable] = path
+	}
+}
+
+// taskIdentity returns the workload identity of a task with a name.
+func taskIdentity(task *api.Task, name string) *api.WorkloadIdentity {
+	if name == defaultIdentityName {
+		return task.Identity
+	}
+	for _, identity := range task.Identities {
+		if identity.Name == name {
+			return identity
+		}
+	}
+	return nil
+}
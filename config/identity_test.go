@@ -0,0 +1,94 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestApplyIdentities(t *testing.T) {
+	task_type := &TaskType{
+		Identities: []*TaskIdentity{
+			{Name: "default"},
+			{Name: "aws", Audience: []string{"sts.amazonaws.com"}, TTL: "1h", IDToken: "AWS_TOKEN"},
+			{Name: "gcp", Audience: []string{"gcp"}},
+		},
+	}
+	for _, identity := range task_type.Identities {
+		if err := identity.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		variables  map[string]string
+		identities []string
+		env        map[string]string
+	}{
+		{
+			name:       "without id_token",
+			identities: []string{"gcp"},
+			env: map[string]string{
+				"NOMAD_IDENTITY_FILE":     "${NOMAD_SECRETS_DIR}/nomad_token",
+				"NOMAD_IDENTITY_FILE_gcp": "${NOMAD_SECRETS_DIR}/nomad_gcp.jwt",
+			},
+		},
+		{
+			name:       "with id_token",
+			variables:  map[string]string{"AWS_TOKEN": "eyJ..."},
+			identities: []string{"aws", "gcp"},
+			env: map[string]string{
+				"NOMAD_IDENTITY_FILE":     "${NOMAD_SECRETS_DIR}/nomad_token",
+				"AWS_TOKEN_FILE":          "${NOMAD_SECRETS_DIR}/nomad_aws.jwt",
+				"NOMAD_IDENTITY_FILE_gcp": "${NOMAD_SECRETS_DIR}/nomad_gcp.jwt",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &api.Task{}
+			task_type.ApplyIdentities(task, func(name string) (string, bool) {
+				value, ok := test.variables[name]
+				return value, ok
+			})
+			if task.Identity == nil || !task.Identity.File {
+				t.Errorf("default identity = %+v, want a file", task.Identity)
+			}
+			var names []string
+			for _, identity := range task.Identities {
+				names = append(names, identity.Name)
+				if !identity.File {
+					t.Errorf("identity %s is not written to a file", identity.Name)
+				}
+				if identity.Name == "aws" && identity.TTL != time.Hour {
+					t.Errorf("identity aws TTL = %s, want 1h", identity.TTL)
+				}
+			}
+			if len(names) != len(test.identities) {
+				t.Fatalf("identities = %v, want %v", names, test.identities)
+			}
+			for i := range names {
+				if names[i] != test.identities[i] {
+					t.Errorf("identities = %v, want %v", names, test.identities)
+				}
+			}
+			if len(task.Env) != len(test.env) {
+				t.Errorf("env = %v, want %v", task.Env, test.env)
+			}
+			for key, value := range test.env {
+				if task.Env[key] != value {
+					t.Errorf("env %s = %q, want %q", key, task.Env[key], value)
+				}
+			}
+		})
+	}
+
+	// Identities defined by the task of a job template are kept.
+	task := &api.Task{Identities: []*api.WorkloadIdentity{{Name: "gcp", Audience: []string{"custom"}}}}
+	task_type.ApplyIdentities(task, func(string) (string, bool) { return "", false })
+	if len(task.Identities) != 1 || task.Identities[0].Audience[0] != "custom" {
+		t.Errorf("identities = %+v, want the gcp identity of the task", task.Identities)
+	}
+}
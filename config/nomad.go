@@ -8,7 +8,7 @@ func (t *TaskType) CreateNomadTask(data map[string]interface{}) (*api.Task, erro
 		return nil, err
 	}
 
-	return &api.Task{
+	task := &api.Task{
 		Driver:      t.Driver,
 		User:        t.User,
 		Config:      config,
@@ -16,5 +16,14 @@ func (t *TaskType) CreateNomadTask(data map[string]interface{}) (*api.Task, erro
 		Affinities:  t.Affinities,
 		Resources:   t.Resources,
 		Meta:        t.Meta,
-	}, nil
+	}
+	return task, nil
+}
+
+// ApplyJobSettings applies to a task the settings of its task type which
+// depend on the CI job: the overrides and workload identities. Unlike the
+// others, they also apply to the tasks of the job template.
+func (t *TaskType) ApplyJobSettings(task *api.Task, lookup func(string) (string, bool)) error {
+	t.ApplyIdentities(task, lookup)
+	return t.ApplyOverrides(task, lookup)
 }
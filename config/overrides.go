@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+var taskOverrides = []string{"cpu", "memory", "memory_max"}
+
+var jobOverrides = []string{"datacenter", "node_class"}
+
+// jobOverrideVariable returns the variable requesting a job override, e.g.
+// NOMAD_DATACENTER.
+func jobOverrideVariable(name string) string {
+	return "NOMAD_" + strings.ToUpper(name)
+}
+
+// taskOverrideVariable returns the variable requesting an override of the
+// tasks of a type, e.g. NOMAD_JOB_MEMORY for the memory of the job task.
+func taskOverrideVariable(task_type string, name string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(task_type))
+	return "NOMAD_" + prefix + "_" + strings.ToUpper(name)
+}
+
+// Override allows CI jobs to change a scheduling setting through a variable,
+// within min and max bounds for resources or among allowed values.
+type Override struct {
+	Name    string   `hcl:"name,label"`
+	Min     *int     `hcl:"min,optional"`
+	Max     *int     `hcl:"max,optional"`
+	Allowed []string `hcl:"allowed,optional"`
+}
+
+func (o *Override) validate(names []string) error {
+	found := false
+	for _, name := range names {
+		found = found || name == o.Name
+	}
+	if !found {
+		return fmt.Errorf("unsupported override '%s', expected one of %v", o.Name, names)
+	}
+	if o.Name == "datacenter" || o.Name == "node_class" {
+		if len(o.Allowed) == 0 || o.Min != nil || o.Max != nil {
+			return fmt.Errorf("override '%s' requires allowed values only", o.Name)
+		}
+		return nil
+	}
+	if o.Max == nil || len(o.Allowed) > 0 {
+		return fmt.Errorf("override '%s' requires a max bound and no allowed values", o.Name)
+	}
+	if o.Min != nil && *o.Min > *o.Max {
+		return fmt.Errorf("override '%s' min is greater than max", o.Name)
+	}
+	return nil
+}
+
+// value returns the value requested through the variable of the override,
+// checked against the bounds or allowed values.
+func (o *Override) value(variable string, lookup func(string) (string, bool)) (string, bool, error) {
+	value, ok := lookup(variable)
+	if !ok || value == "" {
+		return "", false, nil
+	}
+
+	if len(o.Allowed) > 0 {
+		for _, allowed := range o.Allowed {
+			if value == allowed {
+				return value, true, nil
+			}
+		}
+		return "", false, fmt.Errorf("%s=%s is not one of the allowed values %v", variable, value, o.Allowed)
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return "", false, fmt.Errorf("%s=%s is not a number", variable, value)
+	}
+	if o.Min != nil && number < *o.Min {
+		return "", false, fmt.Errorf("%s=%d is below the minimum of %d", variable, number, *o.Min)
+	}
+	if number > *o.Max {
+		return "", false, fmt.Errorf("%s=%d exceeds the maximum of %d", variable, number, *o.Max)
+	}
+	return value, true, nil
+}
+
+// ApplyOverrides changes the resources of a task with the values requested by
+// the CI job for the tasks of this type.
+func (t *TaskType) ApplyOverrides(task *api.Task, lookup func(string) (string, bool)) error {
+	for _, override := range t.Overrides {
+		value, ok, err := override.value(taskOverrideVariable(t.Type, override.Name), lookup)
+		if err != nil {
+			return fmt.Errorf("task %s: %w", t.Type, err)
+		}
+		if !ok {
+			continue
+		}
+		// The resources are shared by every task of this type.
+		resources := &api.Resources{}
+		if task.Resources != nil {
+			*resources = *task.Resources
+		}
+		task.Resources = resources
+
+		number, _ := strconv.Atoi(value)
+		switch override.Name {
+		case "cpu":
+			resources.CPU = &number
+		case "memory":
+			resources.MemoryMB = &number
+		case "memory_max":
+			resources.MemoryMaxMB = &number
+		}
+	}
+	return nil
+}
+
+// ApplyOverrides changes the datacenters and node class of a job with the
+// values requested by the CI job.
+func (j *Job) ApplyOverrides(job *api.Job, lookup func(string) (string, bool)) error {
+	for _, override := range j.Overrides {
+		value, ok, err := override.value(jobOverrideVariable(override.Name), lookup)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch override.Name {
+		case "datacenter":
+			job.Datacenters = []string{value}
+		case "node_class":
+			job.Constrain(api.NewConstraint("${node.class}", "=", value))
+		}
+	}
+	return nil
+}
+
+// UndeclaredOverrides describes the overrides requested by the CI job which are
+// not declared in the configuration, so that ignoring them can be reported.
+func (j *Job) UndeclaredOverrides(lookup func(string) (string, bool)) []string {
+	declared := map[string]bool{}
+	for _, override := range j.Overrides {
+		declared[jobOverrideVariable(override.Name)] = true
+	}
+	variables := map[string]string{}
+	for _, name := range jobOverrides {
+		variables[jobOverrideVariable(name)] = name
+	}
+	for _, task_type := range j.TaskTypes {
+		for _, override := range task_type.Overrides {
+			declared[taskOverrideVariable(task_type.Type, override.Name)] = true
+		}
+		for _, name := range taskOverrides {
+			variables[taskOverrideVariable(task_type.Type, name)] = fmt.Sprintf("%s of task %s", name, task_type.Type)
+		}
+	}
+	var undeclared []string
+	for variable, name := range variables {
+		if value, ok := lookup(variable); ok && value != "" && !declared[variable] {
+			undeclared = append(undeclared, fmt.Sprintf("%s is set but the runner does not allow overriding %s", variable, name))
+		}
+	}
+	sort.Strings(undeclared)
+	return undeclared
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverrideVariables(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{jobOverrideVariable("node_class"), "NOMAD_NODE_CLASS"},
+		{taskOverrideVariable("job", "memory_max"), "NOMAD_JOB_MEMORY_MAX"},
+		{taskOverrideVariable("build-arm", "cpu"), "NOMAD_BUILD_ARM_CPU"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("override variable = %s, want %s", test.got, test.want)
+		}
+	}
+}
+
+func TestOverrideValue(t *testing.T) {
+	ptr := func(i int) *int { return &i }
+	memory := &Override{Name: "memory", Min: ptr(128), Max: ptr(4096)}
+	datacenter := &Override{Name: "datacenter", Allowed: []string{"dc1", "dc2"}}
+
+	tests := []struct {
+		name     string
+		override *Override
+		value    string
+		set      bool
+		want     string
+		ok       bool
+		err      bool
+	}{
+		{name: "unset", override: memory},
+		{name: "empty", override: memory, value: "", set: true},
+		{name: "within bounds", override: memory, value: "2048", set: true, want: "2048", ok: true},
+		{name: "at the bounds", override: memory, value: "4096", set: true, want: "4096", ok: true},
+		{name: "below the minimum", override: memory, value: "64", set: true, err: true},
+		{name: "above the maximum", override: memory, value: "8192", set: true, err: true},
+		{name: "not a number", override: memory, value: "2G", set: true, err: true},
+		{name: "allowed value", override: datacenter, value: "dc2", set: true, want: "dc2", ok: true},
+		{name: "disallowed value", override: datacenter, value: "dc3", set: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookup := func(name string) (string, bool) {
+				if name != "NOMAD_JOB_"+strings.ToUpper(test.override.Name) {
+					t.Errorf("unexpected lookup of %s", name)
+				}
+				return test.value, test.set
+			}
+			got, ok, err := test.override.value(taskOverrideVariable("job", test.override.Name), lookup)
+			if (err != nil) != test.err {
+				t.Fatalf("value() error = %v, want error %v", err, test.err)
+			}
+			if got != test.want || ok != test.ok {
+				t.Errorf("value() = %q, %v, want %q, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestUndeclaredOverrides(t *testing.T) {
+	job := &Job{
+		Overrides: []*Override{{Name: "datacenter", Allowed: []string{"dc1"}}},
+		TaskTypes: []*TaskType{
+			{Type: "job", Overrides: []*Override{{Name: "memory", Max: new(int)}}},
+			{Type: "service"},
+		},
+	}
+	variables := map[string]string{
+		"NOMAD_DATACENTER":     "dc1",
+		"NOMAD_NODE_CLASS":     "large",
+		"NOMAD_JOB_MEMORY":     "1024",
+		"NOMAD_JOB_CPU":        "",
+		"NOMAD_SERVICE_MEMORY": "512",
+	}
+	got := job.UndeclaredOverrides(func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	})
+	want := []string{
+		"NOMAD_NODE_CLASS is set but the runner does not allow overriding node_class",
+		"NOMAD_SERVICE_MEMORY is set but the runner does not allow overriding memory of task service",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UndeclaredOverrides() = %q, want %q", got, want)
+	}
+}
@@ -6,27 +6,100 @@ nomad {
 
 image = "ubuntu"
 helper_image = "registry.gitlab.com/gitlab-org/gitlab-runner/gitlab-runner-helper:alpine-latest-x86_64-v15.10.0"
+# The "never" pull policy is rejected: the Nomad docker driver always pulls
+# images missing from the node.
+pull_policy = ["always"]
+allowed_pull_policies = ["always", "if-not-present"]
+# A complete Nomad jobspec can replace the job assembled from the task types.
+# The overrides and identities of the task types still apply to the tasks named
+# after them, separate_group is not supported.
+# job_template_file = "job.nomad.hcl"
 
 job {
   datacenters = ["dc1"]
   alloc_data_dir = "/alloc/data"
+  placement_timeout = "10m"
+  timeout_grace_period = "5m"
+  # Prefer the node the last job of the project and branch ran on.
+  # sticky_node_weight = 50
+  # Prefer the nodes which ran the images of the job within the window.
+  # image_locality_weight = 30
+  # image_locality_window = "24h"
+
+  # Placement rules of the jobs with a GitLab runner tag.
+  # tag "gpu" {
+  #   node_pool = "gpu"
+  # }
+
+  # Vault role and namespace used to render the GitLab CI secrets of the jobs.
+  # vault {
+  #   role      = "gitlab-jobs"
+  #   namespace = "ci"
+  # }
+
+  # Persistent GitLab cache, in a directory per key of the volume. The CI_JOB_ID
+  # and CI_PROJECT_* variables of the key come from the job response, the
+  # other variables can be set by the jobs: keys should start with the project
+  # path to keep the caches of the projects apart.
+  # cache {
+  #   type   = "host"
+  #   source = "gitlab-cache"
+  #   key    = "{{.CI_PROJECT_PATH}}/{{.CI_COMMIT_REF_SLUG}}"
+  # }
+
+  # Builds directories reused by the jobs of a project, on a host volume. A
+  # project runs at most this number of jobs with a shared builds directory.
+  # builds {
+  #   source = "gitlab-builds"
+  #   slots  = 2
+  # }
 
   upstreams {
     destination_name = "gitlab-http"
     local_bind_port = 50000
   }
 
+  # Set by the jobs with NOMAD_DATACENTER and NOMAD_NODE_CLASS.
+  override "node_class" {
+    allowed = ["large"]
+  }
+
   task "job" {
     driver = "docker"
 
+    # Nomad workload identities written to files, e.g. for cloud OIDC. With
+    # id_token, the identity is only requested for the jobs defining this GitLab
+    # id_token and AWS_TOKEN_FILE holds the path of its file. The "default"
+    # identity, used with the Nomad API, is in NOMAD_IDENTITY_FILE.
+    # identity "aws" {
+    #   aud      = ["sts.amazonaws.com"]
+    #   ttl      = "1h"
+    #   id_token = "AWS_TOKEN"
+    # }
+
+    # Set by the jobs with NOMAD_<TYPE>_CPU, NOMAD_<TYPE>_MEMORY and
+    # NOMAD_<TYPE>_MEMORY_MAX, e.g. NOMAD_JOB_MEMORY for this task.
+    override "cpu" {
+      min = 100
+      max = 4000
+    }
+
+    override "memory" {
+      min = 128
+      max = 8192
+    }
+
     config = <<-EOT
       image = "{{.Image}}"
+      force_pull = {{.ForcePull}}
       {{if gt (len .Entrypoint) 0 -}}
       entrypoint = {{.Entrypoint | hcl}}
       {{else -}}
       command = "sh"
       {{end -}}
       args = ["{{.ExecScript}}"]
+      extra_hosts = {{.ExtraHosts | hcl}}
+      ports = {{.PortLabels | hcl}}
       {{with .Auth -}}
       auth = {
         username = "{{.Username}}"
@@ -41,8 +114,10 @@ job {
 
     config = <<-EOT
       image = "{{.Image}}"
+      force_pull = {{.ForcePull}}
       command = "sh"
       args = ["{{.ExecScript}}"]
+      extra_hosts = {{.ExtraHosts | hcl}}
       {{with .Auth -}}
       auth = {
         username = "{{.Username}}"
@@ -54,13 +129,20 @@ job {
 
   task "service" {
     driver = "docker"
+    # Run each service in its own task group, reachable through Consul Connect.
+    # The group is led by a keepalive task of the helper task type, which stops
+    # with the job.
+    # separate_group = true
 
     config = <<-EOT
       image = "{{.Service.Name}}"
-      entrypoint = {{.Service.Entrypoint | hcl}}
-      {{if gt (len .Service.Command) 0 -}}
-      command = "{{index .Service.Command 0}}"
-      args = {{slice (.Service.Command | deref) 1 | hcl}}
+      force_pull = {{.ForcePull}}
+      {{with deref .Service.Entrypoint -}}
+      entrypoint = {{. | hcl}}
+      {{end -}}
+      {{with deref .Service.Command -}}
+      command = "{{index . 0}}"
+      args = {{slice . 1 | hcl}}
       {{end -}}
       {{with .Auth -}}
       auth = {
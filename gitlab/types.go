@@ -1,7 +1,12 @@
 package gitlab
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 )
 
 type BuildError int
@@ -11,10 +16,53 @@ func (e BuildError) Error() string {
 }
 
 type JobService struct {
-	Name       string    `json:"name"`
-	Alias      string    `json:"alias"`
-	Entrypoint *[]string `json:"entrypoint"`
-	Command    *[]string `json:"command"`
+	Name         string        `json:"name"`
+	Alias        string        `json:"alias"`
+	Entrypoint   *[]string     `json:"entrypoint"`
+	Command      *[]string     `json:"command"`
+	Ports        []JobPort     `json:"ports,omitempty"`
+	Variables    []JobVariable `json:"variables,omitempty"`
+	PullPolicies []string      `json:"pull_policy,omitempty"`
+}
+
+type JobPort struct {
+	Number   int    `json:"number,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+type JobVariable struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Public bool   `json:"public"`
+	File   bool   `json:"file"`
+	Masked bool   `json:"masked"`
+	Raw    bool   `json:"raw"`
+}
+
+// Env returns the variables as environment variables.
+func Env(variables []JobVariable) map[string]string {
+	env := map[string]string{}
+	for _, variable := range variables {
+		env[variable.Key] = variable.Value
+	}
+	return env
+}
+
+// ParseRunnerTags parses CI_RUNNER_TAGS, which is either a JSON array or a
+// comma-separated list depending on the GitLab version.
+func ParseRunnerTags(value string) []string {
+	var tags []string
+	if err := json.Unmarshal([]byte(value), &tags); err == nil {
+		return tags
+	}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
 type DockerAuthConfig struct {
@@ -22,13 +70,110 @@ type DockerAuthConfig struct {
 }
 
 type JobResponseImage struct {
-	Name         string           `json:"name"`
-	Alias        string           `json:"alias,omitempty"`
-	Command      []string         `json:"command,omitempty"`
-	Entrypoint   []string         `json:"entrypoint,omitempty"`
-	Ports        []map[string]any `json:"ports,omitempty"`
-	Variables    []map[string]any `json:"variables,omitempty"`
-	PullPolicies []string         `json:"pull_policy,omitempty"`
+	Name         string        `json:"name"`
+	Alias        string        `json:"alias,omitempty"`
+	Command      []string      `json:"command,omitempty"`
+	Entrypoint   []string      `json:"entrypoint,omitempty"`
+	Ports        []JobPort     `json:"ports,omitempty"`
+	Variables    []JobVariable `json:"variables,omitempty"`
+	PullPolicies []string      `json:"pull_policy,omitempty"`
+}
+
+// Secret is a secret of the job response, only Vault secrets are supported.
+type Secret struct {
+	Vault *VaultSecret `json:"vault,omitempty"`
+	// File exposes the secret as a file whose path is the variable value,
+	// which is the default.
+	File *bool `json:"file,omitempty"`
+}
+
+type VaultSecret struct {
+	Engine VaultEngine `json:"engine"`
+	Path   string      `json:"path"`
+	Field  string      `json:"field"`
+}
+
+type VaultEngine struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type JobInfo struct {
+	ID        int64 `json:"id"`
+	ProjectID int64 `json:"project_id"`
+}
+
+type GitInfo struct {
+	RepoURL string `json:"repo_url"`
+}
+
+// JobIdentity identifies a job and its project. It is read from the job
+// response, unlike the CI_JOB_ID and CI_PROJECT_* variables which can be
+// overridden by the variables of the job.
+type JobIdentity struct {
+	JobID     string
+	ProjectID string
+	// ProjectPath is the path of the repository URL, without the relative
+	// URL root of GitLab instances served under a sub-path.
+	ProjectPath      string
+	ProjectNamespace string
+}
+
+// ParseJobIdentity returns the identity of the job of a job response.
+func ParseJobIdentity(response map[string]json.RawMessage) (JobIdentity, error) {
+	job_info := JobInfo{}
+	err := json.Unmarshal(response["job_info"], &job_info)
+	if err != nil {
+		return JobIdentity{}, fmt.Errorf("cannot unmarshal job info from response file: %w", err)
+	}
+	git_info := GitInfo{}
+	err = json.Unmarshal(response["git_info"], &git_info)
+	if err != nil {
+		return JobIdentity{}, fmt.Errorf("cannot unmarshal git info from response file: %w", err)
+	}
+	repo_url, err := url.Parse(git_info.RepoURL)
+	if err != nil {
+		return JobIdentity{}, fmt.Errorf("invalid repository URL in response file: %w", err)
+	}
+	project_path := strings.TrimSuffix(strings.Trim(repo_url.Path, "/"), ".git")
+	if root := relativeURLRoot(response, repo_url.Host); root != "" && strings.HasPrefix(project_path, root+"/") {
+		project_path = strings.TrimPrefix(project_path, root+"/")
+	}
+	if job_info.ID == 0 || job_info.ProjectID == 0 || project_path == "" {
+		return JobIdentity{}, fmt.Errorf("no job or project in response file")
+	}
+	return JobIdentity{
+		JobID:            strconv.FormatInt(job_info.ID, 10),
+		ProjectID:        strconv.FormatInt(job_info.ProjectID, 10),
+		ProjectPath:      project_path,
+		ProjectNamespace: path.Dir(project_path),
+	}, nil
+}
+
+// relativeURLRoot returns the path of the CI_SERVER_URL variable of a job
+// response when it is served by host. The predefined variables come first,
+// so a variable of the job cannot replace it.
+func relativeURLRoot(response map[string]json.RawMessage, host string) string {
+	var variables []JobVariable
+	if err := json.Unmarshal(response["variables"], &variables); err != nil {
+		return ""
+	}
+	for _, variable := range variables {
+		if variable.Key != "CI_SERVER_URL" {
+			continue
+		}
+		server_url, err := url.Parse(variable.Value)
+		if err != nil || server_url.Host != host {
+			return ""
+		}
+		return strings.Trim(server_url.Path, "/")
+	}
+	return ""
+}
+
+type RunnerInfo struct {
+	// Timeout is the job timeout in seconds.
+	Timeout int `json:"timeout"`
 }
 
 // https://gitlab.com/gitlab-org/gitlab-runner/blob/main/executors/custom/api/config.go
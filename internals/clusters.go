@@ -0,0 +1,129 @@
+package internals
+
+import (
+	"context"
+	"fmt"
+	"giruno/config"
+	"log"
+	"math"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const clusterProbeTimeout = 5 * time.Second
+
+// SelectCluster probes the configured clusters and returns the name of the one
+// the job should run on, according to the cluster selection strategy.
+func SelectCluster(Config config.Config) (string, error) {
+	if len(Config.Clusters) == 1 {
+		return Config.Clusters[0].Name, nil
+	}
+
+	var selected string
+	selected_load := math.Inf(1)
+	for _, cluster := range Config.Clusters {
+		cluster_config := Config
+		cluster_config.Nomad = *cluster
+		nomad, err := NewNomad(cluster_config)
+		if err != nil {
+			return "", err
+		}
+
+		err = nomad.probeLeader()
+		if err != nil {
+			log.Printf("Nomad cluster '%s' is unhealthy: %v", cluster.Name, err)
+			continue
+		}
+		if Config.ClusterSelection == config.ClusterSelectionFailover {
+			return cluster.Name, nil
+		}
+
+		load, err := nomad.probeLoad()
+		if err != nil {
+			log.Printf("Cannot compute the load of Nomad cluster '%s': %v", cluster.Name, err)
+			load = 1
+		}
+		// Clusters are sorted by priority, ties keep the preferred cluster.
+		if load < selected_load {
+			selected, selected_load = cluster.Name, load
+		}
+	}
+	if selected == "" {
+		return "", fmt.Errorf("no healthy Nomad cluster")
+	}
+	return selected, nil
+}
+
+// probeLeader checks that the cluster is reachable and has a leader.
+func (n *Nomad) probeLeader() error {
+	ctx, cancel := context.WithTimeout(n.ctx, clusterProbeTimeout)
+	defer cancel()
+
+	var leader string
+	_, err := n.client.Raw().Query("/v1/status/leader", &leader, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if leader == "" {
+		return fmt.Errorf("no cluster leader")
+	}
+	return nil
+}
+
+// probeLoad returns the fraction of the CPU or memory of the schedulable nodes
+// which is allocated, whichever is the highest.
+func (n *Nomad) probeLoad() (float64, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, clusterProbeTimeout)
+	defer cancel()
+
+	q := (&api.QueryOptions{
+		Params: map[string]string{"resources": "true"},
+	}).WithContext(ctx)
+	nodes, _, err := n.client.Nodes().List(q)
+	if err != nil {
+		return 0, err
+	}
+	var total_cpu, total_memory int64
+	for _, node := range nodes {
+		if node.Status != "ready" || node.Drain || node.SchedulingEligibility != api.NodeSchedulingEligible || node.NodeResources == nil {
+			continue
+		}
+		total_cpu += node.NodeResources.Cpu.CpuShares
+		total_memory += node.NodeResources.Memory.MemoryMB
+		if node.ReservedResources != nil {
+			total_cpu -= int64(node.ReservedResources.Cpu.CpuShares)
+			total_memory -= int64(node.ReservedResources.Memory.MemoryMB)
+		}
+	}
+	if total_cpu <= 0 || total_memory <= 0 {
+		return 1, nil
+	}
+
+	q = (&api.QueryOptions{
+		Namespace: "*",
+		Filter:    `ClientStatus == "running" or ClientStatus == "pending"`,
+		Params:    map[string]string{"resources": "true"},
+	}).WithContext(ctx)
+	allocs, _, err := n.client.Allocations().List(q)
+	if err != nil {
+		return 0, err
+	}
+	var used_cpu, used_memory int64
+	for _, alloc := range allocs {
+		if alloc.AllocatedResources == nil {
+			continue
+		}
+		for _, task := range alloc.AllocatedResources.Tasks {
+			used_cpu += task.Cpu.CpuShares
+			used_memory += task.Memory.MemoryMB
+		}
+	}
+
+	cpu_load := float64(used_cpu) / float64(total_cpu)
+	memory_load := float64(used_memory) / float64(total_memory)
+	if cpu_load > memory_load {
+		return cpu_load, nil
+	}
+	return memory_load, nil
+}
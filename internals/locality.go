@@ -0,0 +1,123 @@
+package internals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/hashicorp/nomad/api"
+)
+
+// imageNodesLimit is the maximum number of nodes remembered for an image, the
+// most recent ones are kept.
+const imageNodesLimit = 20
+
+// imageReferenceItem holds the image reference in the variable of an image,
+// the other items map node IDs to the last time they ran the image.
+const imageReferenceItem = "image"
+
+// imageReference normalizes an image reference, so that the different names of
+// an image share their nodes.
+func imageReference(image string) string {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.TagNameOnly(ref).String()
+}
+
+// imageVariablePath returns the path of the Nomad variable holding the nodes
+// which ran an image, image references are not valid variable paths.
+func imageVariablePath(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return "giruno/images/" + hex.EncodeToString(sum[:16])
+}
+
+func uniqueImageReferences(images []string) []string {
+	var refs []string
+	seen := map[string]bool{}
+	for _, image := range images {
+		ref := imageReference(image)
+		if image != "" && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// recentImageNodes returns the nodes of the variable of an image which ran it
+// since a time, most recent first.
+func recentImageNodes(items api.VariableItems, since time.Time) []string {
+	var nodes []string
+	last_run := map[string]int64{}
+	for key, value := range items {
+		if key == imageReferenceItem {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || timestamp < since.Unix() {
+			continue
+		}
+		nodes = append(nodes, key)
+		last_run[key] = timestamp
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return last_run[nodes[i]] > last_run[nodes[j]]
+	})
+	if len(nodes) > imageNodesLimit {
+		nodes = nodes[:imageNodesLimit]
+	}
+	return nodes
+}
+
+// ImageAffinities returns an affinity per image to the nodes which ran it
+// within the window, as their Docker image cache likely still holds it.
+func ImageAffinities(nomad NomadClient, namespace string, images []string, window time.Duration, weight int8) ([]*api.Affinity, error) {
+	var affinities []*api.Affinity
+	for _, image := range uniqueImageReferences(images) {
+		items, err := nomad.GetVariable(namespace, imageVariablePath(image))
+		if err != nil {
+			return nil, err
+		}
+		nodes := recentImageNodes(items, time.Now().Add(-window))
+		if len(nodes) == 0 {
+			continue
+		}
+		affinities = append(affinities, api.NewAffinity("${node.unique.id}", "set_contains_any", strings.Join(nodes, ","), weight))
+	}
+	return affinities, nil
+}
+
+// RecordImageNode records that a node ran images, forgetting the nodes which
+// did not run them within the window. Concurrent jobs may overwrite each other
+// records, which only loses placement hints.
+func RecordImageNode(nomad NomadClient, namespace string, images []string, node string, window time.Duration) error {
+	now := time.Now()
+	for _, image := range uniqueImageReferences(images) {
+		path := imageVariablePath(image)
+		items, err := nomad.GetVariable(namespace, path)
+		if err != nil {
+			return err
+		}
+
+		updated := api.VariableItems{
+			imageReferenceItem: image,
+			node:               strconv.FormatInt(now.Unix(), 10),
+		}
+		for _, recent := range recentImageNodes(items, now.Add(-window)) {
+			if _, ok := updated[recent]; !ok && len(updated) <= imageNodesLimit {
+				updated[recent] = items[recent]
+			}
+		}
+		err = nomad.PutVariable(namespace, path, updated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package internals
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestRecentImageNodes(t *testing.T) {
+	now := time.Now()
+	at := func(age time.Duration) string {
+		return strconv.FormatInt(now.Add(-age).Unix(), 10)
+	}
+	many := api.VariableItems{imageReferenceItem: "docker.io/library/alpine:latest"}
+	var most_recent []string
+	for i := 0; i < imageNodesLimit+5; i++ {
+		node := fmt.Sprintf("node-%02d", i)
+		many[node] = at(time.Duration(i) * time.Minute)
+		if i < imageNodesLimit {
+			most_recent = append(most_recent, node)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		items api.VariableItems
+		want  []string
+	}{
+		{"no variable", nil, nil},
+		{
+			name: "most recent first",
+			items: api.VariableItems{
+				imageReferenceItem: "docker.io/library/alpine:latest",
+				"node-a":           at(2 * time.Hour),
+				"node-b":           at(10 * time.Minute),
+				"node-c":           at(5 * time.Hour),
+			},
+			want: []string{"node-b", "node-a", "node-c"},
+		},
+		{
+			name: "outside the window",
+			items: api.VariableItems{
+				"node-a": at(2 * time.Hour),
+				"node-b": at(48 * time.Hour),
+			},
+			want: []string{"node-a"},
+		},
+		{
+			name: "invalid timestamp",
+			items: api.VariableItems{
+				"node-a": "yesterday",
+				"node-b": at(time.Hour),
+			},
+			want: []string{"node-b"},
+		},
+		{"limited", many, most_recent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := recentImageNodes(test.items, now.Add(-24*time.Hour))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("recentImageNodes() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
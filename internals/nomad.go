@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"giruno/config"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"sort"
@@ -21,6 +22,63 @@ type RegistryAuth struct {
 	Password string
 }
 
+type RegistrationStatus int
+
+const (
+	// RegistrationPlaced means the scheduler placed every allocation of the job.
+	RegistrationPlaced RegistrationStatus = iota
+	// RegistrationBlocked means the job is registered but waits for capacity.
+	RegistrationBlocked
+	// RegistrationFailed means the scheduler could not process the job.
+	RegistrationFailed
+)
+
+func (s RegistrationStatus) String() string {
+	switch s {
+	case RegistrationPlaced:
+		return "placed"
+	case RegistrationBlocked:
+		return "blocked"
+	default:
+		return "failed"
+	}
+}
+
+// Registration is the outcome of the evaluation of a registered job.
+type Registration struct {
+	Status RegistrationStatus
+	// EvalID is the last evaluation followed.
+	EvalID string
+	// BlockedEvalID is the evaluation waiting for capacity, if any.
+	BlockedEvalID string
+	// FailedTGAllocs holds the placement metrics of the task groups which
+	// could not be placed.
+	FailedTGAllocs map[string]*api.AllocationMetric
+	Description    string
+}
+
+// NomadClient is the set of Nomad operations used by the executor stages.
+type NomadClient interface {
+	Cancel()
+	ParseJob(jobHCL string) (*api.Job, error)
+	ValidateJob(job *api.Job) error
+	RegisterJob(job *api.Job) (*Registration, error)
+	TrackEvaluation(evalID string) (*Registration, error)
+	WaitForPlacement(registration *Registration, timeout time.Duration, interval time.Duration, progress func(time.Duration, *Registration)) (*Registration, error)
+	WaitForAllocation(jobID string) (*api.Allocation, bool, error)
+	GetTaskLogs(alloc *api.Allocation, task string, std string) (string, error)
+	Exec(alloc *api.Allocation, task string, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	DeregisterJob(jobID string) error
+	Login(authMethod string, jwt string) (*api.ACLToken, error)
+	Logout(accessorID string) error
+	AcquireLock(path string, owner string, ttl time.Duration) (bool, error)
+	ReleaseLock(path string, owner string) error
+	GetVariable(namespace string, path string) (api.VariableItems, error)
+	PutVariable(namespace string, path string, items api.VariableItems) error
+}
+
+var _ NomadClient = (*Nomad)(nil)
+
 type Nomad struct {
 	client *api.Client
 	ctx    context.Context
@@ -45,7 +103,7 @@ func NewNomad(Config config.Config) (*Nomad, error) {
 		address = "http://localhost"
 	}
 
-	if err := api.ConfigureTLS(http_client, api.DefaultConfig().TLSConfig); err != nil {
+	if err := api.ConfigureTLS(http_client, Config.Nomad.TLSConfig()); err != nil {
 		return nil, err
 	}
 	client, err := api.NewClient(&api.Config{
@@ -70,10 +128,26 @@ func (n *Nomad) Cancel() {
 	n.cancel()
 }
 
+// ParseJob parses an HCL2 jobspec with the jobspec2 parser of the Nomad
+// servers.
+func (n *Nomad) ParseJob(jobHCL string) (*api.Job, error) {
+	var job *api.Job
+	err := retry(n.ctx, "job parsing", func() (err error) {
+		job, err = n.client.Jobs().ParseHCLOpts(&api.JobsParseRequest{
+			JobHCL: jobHCL,
+		})
+		return err
+	})
+	return job, err
+}
+
 func (n *Nomad) ValidateJob(job *api.Job) error {
-	q := api.WriteOptions{}
-	q.WithContext(n.ctx)
-	res, _, err := n.client.Jobs().Validate(job, &q)
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	var res *api.JobValidateResponse
+	err := retry(n.ctx, "job validation", func() (err error) {
+		res, _, err = n.client.Jobs().Validate(job, q)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -83,89 +157,361 @@ func (n *Nomad) ValidateJob(job *api.Job) error {
 	return nil
 }
 
-func (n *Nomad) RegisterJob(job *api.Job) error {
-	q_reg := api.WriteOptions{}
-	q_reg.WithContext(n.ctx)
-	res, _, err := n.client.Jobs().Register(job, &q_reg)
-	if err != nil {
+func (n *Nomad) RegisterJob(job *api.Job) (*Registration, error) {
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	var res *api.JobRegisterResponse
+	err := retry(n.ctx, "job registration", func() (err error) {
+		res, _, err = n.client.Jobs().Register(job, q)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return n.TrackEvaluation(res.EvalID)
+}
 
+// TrackEvaluation waits for an evaluation to be processed by the scheduler,
+// following the evaluations it creates, and reports the placement outcome.
+func (n *Nomad) TrackEvaluation(evalID string) (*Registration, error) {
+	return n.trackEvaluation(n.ctx, evalID)
+}
+
+func (n *Nomad) trackEvaluation(ctx context.Context, evalID string) (*Registration, error) {
 	for {
-		q_info := api.QueryOptions{}
-		q_info.WithContext(n.ctx)
-		eval, _, err := n.client.Evaluations().Info(res.EvalID, &q_info)
+		eval, err := n.waitForEvaluation(ctx, evalID)
 		if err != nil {
+			return nil, err
+		}
+
+		switch eval.Status {
+		case api.EvalStatusComplete:
+		case api.EvalStatusBlocked:
+			return &Registration{
+				Status:         RegistrationBlocked,
+				EvalID:         eval.ID,
+				BlockedEvalID:  eval.ID,
+				FailedTGAllocs: eval.FailedTGAllocs,
+			}, nil
+		default:
+			description := eval.StatusDescription
+			if description == "" {
+				description = eval.Status
+			}
+			return &Registration{
+				Status:         RegistrationFailed,
+				EvalID:         eval.ID,
+				FailedTGAllocs: eval.FailedTGAllocs,
+				Description:    description,
+			}, nil
+		}
+
+		if eval.BlockedEval != "" {
+			return &Registration{
+				Status:         RegistrationBlocked,
+				EvalID:         eval.ID,
+				BlockedEvalID:  eval.BlockedEval,
+				FailedTGAllocs: eval.FailedTGAllocs,
+			}, nil
+		}
+		if eval.NextEval != "" {
+			evalID = eval.NextEval
+			continue
+		}
+		if len(eval.FailedTGAllocs) > 0 {
+			return &Registration{
+				Status:         RegistrationFailed,
+				EvalID:         eval.ID,
+				FailedTGAllocs: eval.FailedTGAllocs,
+				Description:    "failed to place all allocations",
+			}, nil
+		}
+		return &Registration{
+			Status: RegistrationPlaced,
+			EvalID: eval.ID,
+		}, nil
+	}
+}
+
+// WaitForPlacement waits for a blocked registration to be placed or to fail,
+// calling progress every interval while it stays blocked. A zero timeout waits
+// until the Nomad context is cancelled.
+func (n *Nomad) WaitForPlacement(registration *Registration, timeout time.Duration, interval time.Duration, progress func(time.Duration, *Registration)) (*Registration, error) {
+	ctx := n.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(n.ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	last_report := start
+	var index uint64
+	for registration.Status == RegistrationBlocked {
+		q := (&api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  interval,
+		}).WithContext(ctx)
+		var eval *api.Evaluation
+		var meta *api.QueryMeta
+		err := retry(ctx, "evaluation query", func() (err error) {
+			eval, meta, err = n.client.Evaluations().Info(registration.BlockedEvalID, q)
 			return err
+		})
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded && n.ctx.Err() == nil {
+				return registration, fmt.Errorf("job was not placed within %s", timeout)
+			}
+			return registration, err
 		}
-		if eval.Status == api.EvalStatusComplete {
-			return nil
+		index = meta.LastIndex
+
+		if eval.Status != api.EvalStatusBlocked {
+			tracked, err := n.trackEvaluation(ctx, eval.ID)
+			if err != nil {
+				if ctx.Err() == context.DeadlineExceeded && n.ctx.Err() == nil {
+					return registration, fmt.Errorf("job was not placed within %s", timeout)
+				}
+				return registration, err
+			}
+			registration = tracked
+			index = 0
+			continue
+		}
+		if len(eval.FailedTGAllocs) > 0 {
+			registration.FailedTGAllocs = eval.FailedTGAllocs
 		}
-		if eval.Status != "pending" {
-			return fmt.Errorf(eval.Status)
+		if time.Since(last_report) >= interval {
+			last_report = time.Now()
+			progress(time.Since(start), registration)
 		}
-		time.Sleep(1 * time.Second)
 	}
+	return registration, nil
 }
 
-func (n *Nomad) WaitForAllocation(jobID string) (*api.Allocation, bool, error) {
-	var id string
+// waitForEvaluation blocks until an evaluation leaves the pending status.
+func (n *Nomad) waitForEvaluation(ctx context.Context, evalID string) (*api.Evaluation, error) {
+	var index uint64
 	for {
-		q := api.QueryOptions{}
-		q.WithContext(n.ctx)
-		allocs, _, err := n.client.Jobs().Allocations(jobID, false, &q)
+		q := (&api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+		}).WithContext(ctx)
+		var eval *api.Evaluation
+		var meta *api.QueryMeta
+		err := retry(ctx, "evaluation query", func() (err error) {
+			eval, meta, err = n.client.Evaluations().Info(evalID, q)
+			return err
+		})
 		if err != nil {
-			return nil, true, err
+			return nil, err
 		}
-		if len(allocs) == 0 {
-			return nil, true, fmt.Errorf("no allocations")
+		if eval.Status != api.EvalStatusPending {
+			return eval, nil
 		}
+		index = meta.LastIndex
+	}
+}
 
-		sort.Slice(allocs, func(i, j int) bool {
-			return allocs[i].CreateIndex > allocs[j].CreateIndex
-		})
+// allocationReady reports whether the most recent allocation of each task
+// group of a job is ready, and returns the ID of the allocation of the job task
+// group, in which the build runs.
+func allocationReady(allocs []*api.AllocationListStub) (string, bool, error) {
+	if len(allocs) == 0 {
+		return "", false, fmt.Errorf("no allocations")
+	}
 
-		alloc_stub := allocs[0]
+	sort.Slice(allocs, func(i, j int) bool {
+		return allocs[i].CreateIndex > allocs[j].CreateIndex
+	})
+
+	latest := map[string]*api.AllocationListStub{}
+	for _, alloc_stub := range allocs {
+		if _, ok := latest[alloc_stub.TaskGroup]; !ok {
+			latest[alloc_stub.TaskGroup] = alloc_stub
+		}
+	}
+	id := allocs[0].ID
+	if alloc_stub, ok := latest["job"]; ok {
 		id = alloc_stub.ID
-		status := alloc_stub.ClientStatus
+	}
 
-		if status == "complete" {
-			break
+	ready := true
+	for _, alloc_stub := range latest {
+		alloc_ready, err := allocationStubReady(alloc_stub)
+		if err != nil {
+			return "", false, err
 		}
+		ready = ready && alloc_ready
+	}
+	return id, ready, nil
+}
+
+// allocationStubReady reports whether an allocation is complete or all of its
+// tasks are running.
+func allocationStubReady(alloc_stub *api.AllocationListStub) (bool, error) {
+	status := alloc_stub.ClientStatus
+
+	if status == api.AllocClientStatusComplete {
+		return true, nil
+	}
+
+	if status == api.AllocClientStatusPending || len(alloc_stub.TaskStates) == 0 {
+		return false, nil
+	}
+
+	if status != api.AllocClientStatusRunning {
+		return false, fmt.Errorf(status)
+	}
 
-		if status == "pending" || len(alloc_stub.TaskStates) == 0 {
-			time.Sleep(200 * time.Millisecond)
+	for _, task := range alloc_stub.TaskStates {
+		// Prestart lifecycle tasks are dead once they succeeded.
+		if task.State == "dead" && !task.Failed {
 			continue
 		}
+		if task.State != "running" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-		if status != "running" {
-			return nil, true, fmt.Errorf(status)
+func (n *Nomad) WaitForAllocation(jobID string) (*api.Allocation, bool, error) {
+	q := (&api.QueryOptions{}).WithContext(n.ctx)
+	var allocs []*api.AllocationListStub
+	var meta *api.QueryMeta
+	err := retry(n.ctx, "job allocations query", func() (err error) {
+		allocs, meta, err = n.client.Jobs().Allocations(jobID, false, q)
+		return err
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	id, ready, err := allocationReady(allocs)
+	if err != nil {
+		return nil, true, err
+	}
+	if !ready {
+		id, err = n.streamAllocations(jobID, allocs, meta.LastIndex)
+		if err != nil {
+			return nil, true, err
 		}
+	}
 
-		ready := true
-		for _, task := range allocs[0].TaskStates {
-			if task.State != "running" {
-				ready = false
+	q = (&api.QueryOptions{}).WithContext(n.ctx)
+	var alloc *api.Allocation
+	err = retry(n.ctx, "allocation query", func() (err error) {
+		alloc, _, err = n.client.Allocations().Info(id, q)
+		return err
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	return alloc, alloc.ServerTerminalStatus(), nil
+}
+
+// streamAllocations follows the allocation events of a job until its most
+// recent allocation is ready. It falls back to blocking queries when the event
+// stream is unavailable (e.g. disabled on the servers or denied by ACLs).
+func (n *Nomad) streamAllocations(jobID string, allocs []*api.AllocationListStub, index uint64) (string, error) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+
+	q := api.QueryOptions{}
+	events, err := n.client.EventStream().Stream(ctx, map[api.Topic][]string{
+		api.TopicAllocation: {jobID},
+	}, index+1, &q)
+	if err != nil {
+		log.Printf("Event stream unavailable, falling back to blocking queries: %v", err)
+		return n.pollAllocations(jobID, index)
+	}
+
+	known := map[string]*api.AllocationListStub{}
+	for _, alloc := range allocs {
+		known[alloc.ID] = alloc
+	}
+
+	for batch := range events {
+		if batch.Err != nil {
+			if n.ctx.Err() != nil {
+				return "", n.ctx.Err()
+			}
+			log.Printf("Event stream interrupted, falling back to blocking queries: %v", batch.Err)
+			return n.pollAllocations(jobID, index)
+		}
+		index = batch.Index
+
+		for _, event := range batch.Events {
+			alloc, err := event.Allocation()
+			if err != nil {
+				return "", err
+			}
+			if alloc == nil || alloc.JobID != jobID {
+				continue
+			}
+			known[alloc.ID] = &api.AllocationListStub{
+				ID:           alloc.ID,
+				TaskGroup:    alloc.TaskGroup,
+				ClientStatus: alloc.ClientStatus,
+				TaskStates:   alloc.TaskStates,
+				CreateIndex:  alloc.CreateIndex,
+				ModifyIndex:  alloc.ModifyIndex,
 			}
 		}
+
+		allocs = allocs[:0]
+		for _, alloc := range known {
+			allocs = append(allocs, alloc)
+		}
+		id, ready, err := allocationReady(allocs)
+		if err != nil {
+			return "", err
+		}
 		if ready {
-			break
+			return id, nil
 		}
-		time.Sleep(1 * time.Second)
 	}
-	q := api.QueryOptions{}
-	q.WithContext(n.ctx)
-	alloc, _, err := n.client.Allocations().Info(id, &q)
-	if err != nil {
-		return nil, true, err
+
+	if n.ctx.Err() != nil {
+		return "", n.ctx.Err()
+	}
+	return n.pollAllocations(jobID, index)
+}
+
+// pollAllocations waits for the most recent allocation of a job to be ready
+// using blocking queries on the job allocations.
+func (n *Nomad) pollAllocations(jobID string, index uint64) (string, error) {
+	for {
+		q := (&api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+		}).WithContext(n.ctx)
+		var allocs []*api.AllocationListStub
+		var meta *api.QueryMeta
+		err := retry(n.ctx, "job allocations query", func() (err error) {
+			allocs, meta, err = n.client.Jobs().Allocations(jobID, false, q)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		id, ready, err := allocationReady(allocs)
+		if err != nil {
+			return "", err
+		}
+		if ready {
+			return id, nil
+		}
+		index = meta.LastIndex
 	}
-	return alloc, alloc.ServerTerminalStatus(), nil
 }
 
 func (n *Nomad) GetTaskLogs(alloc *api.Allocation, task string, std string) (string, error) {
-	q := api.QueryOptions{}
-	q.WithContext(n.ctx)
-	reader, err := n.client.AllocFS().Cat(alloc, "alloc/logs/"+task+"."+std+".0", &q)
+	q := (&api.QueryOptions{}).WithContext(n.ctx)
+	var reader io.ReadCloser
+	err := retry(n.ctx, "task logs query", func() (err error) {
+		reader, err = n.client.AllocFS().Cat(alloc, "alloc/logs/"+task+"."+std+".0", q)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -182,8 +528,32 @@ func (n *Nomad) Exec(alloc *api.Allocation, task string, command []string, stdin
 }
 
 func (n *Nomad) DeregisterJob(jobID string) error {
-	q := api.WriteOptions{}
-	q.WithContext(n.ctx)
-	_, _, err := n.client.Jobs().Deregister(jobID, false, &q) // TODO: purge
-	return err
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	return retry(n.ctx, "job deregistration", func() error {
+		_, _, err := n.client.Jobs().Deregister(jobID, false, q) // TODO: purge
+		return err
+	})
+}
+
+// Login exchanges a JWT for an ACL token through a Nomad auth method.
+func (n *Nomad) Login(authMethod string, jwt string) (*api.ACLToken, error) {
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	var token *api.ACLToken
+	err := retry(n.ctx, "ACL login", func() (err error) {
+		token, _, err = n.client.ACLAuth().Login(&api.ACLLoginRequest{
+			AuthMethodName: authMethod,
+			LoginToken:     jwt,
+		}, q)
+		return err
+	})
+	return token, err
+}
+
+// Logout revokes an ACL token obtained with Login.
+func (n *Nomad) Logout(accessorID string) error {
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	return retry(n.ctx, "ACL logout", func() error {
+		_, err := n.client.ACLTokens().Delete(accessorID, q)
+		return err
+	})
 }
@@ -0,0 +1,251 @@
+package internals_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"giruno/config"
+	"giruno/internals"
+	"giruno/internals/nomadtest"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func newTestNomad(t *testing.T) (*nomadtest.Server, *internals.Nomad) {
+	server := nomadtest.NewServer()
+	t.Cleanup(server.Close)
+	var c config.Config
+	c.Nomad.Address = server.URL
+	c.Nomad.Namespace = "default"
+	nomad, err := internals.NewNomad(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, nomad
+}
+
+func TestLoginLogout(t *testing.T) {
+	server, nomad := newTestNomad(t)
+
+	token, err := nomad.Login("gitlab", "job.jwt")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if token.SecretID == "" || server.Token(token.AccessorID) == nil {
+		t.Fatalf("Login() = %+v, want a token known by the server", token)
+	}
+
+	err = nomad.Logout(token.AccessorID)
+	if err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	if server.Token(token.AccessorID) != nil {
+		t.Errorf("Logout() did not revoke the token")
+	}
+	if err := nomad.Logout(token.AccessorID); err == nil {
+		t.Errorf("Logout() of a revoked token succeeded")
+	}
+
+	if _, err := nomad.Login("gitlab", ""); err == nil {
+		t.Errorf("Login() without JWT succeeded")
+	}
+}
+
+func TestLocks(t *testing.T) {
+	server, nomad := newTestNomad(t)
+	const lock = "giruno/builds/1/0"
+
+	acquired, err := nomad.AcquireLock(lock, "job-1", time.Hour)
+	if err != nil || !acquired {
+		t.Fatalf("AcquireLock(job-1) = %v, %v, want the lock", acquired, err)
+	}
+	acquired, err = nomad.AcquireLock(lock, "job-2", time.Hour)
+	if err != nil || acquired {
+		t.Fatalf("AcquireLock(job-2) = %v, %v, want the lock held by job-1", acquired, err)
+	}
+
+	// Releasing the lock of another owner keeps it.
+	err = nomad.ReleaseLock(lock, "job-2")
+	if err != nil || server.Variable(lock) == nil {
+		t.Fatalf("ReleaseLock(job-2) = %v, want the lock kept", err)
+	}
+	err = nomad.ReleaseLock(lock, "job-1")
+	if err != nil || server.Variable(lock) != nil {
+		t.Fatalf("ReleaseLock(job-1) = %v, want the lock released", err)
+	}
+
+	// Expired locks are taken over.
+	acquired, err = nomad.AcquireLock(lock, "job-3", -time.Second)
+	if err != nil || !acquired {
+		t.Fatalf("AcquireLock(job-3) = %v, %v, want the lock", acquired, err)
+	}
+	acquired, err = nomad.AcquireLock(lock, "job-4", time.Hour)
+	if err != nil || !acquired {
+		t.Fatalf("AcquireLock(job-4) = %v, %v, want the expired lock", acquired, err)
+	}
+	if owner := server.Variable(lock).Items["owner"]; owner != "job-4" {
+		t.Errorf("lock owner = %q, want job-4", owner)
+	}
+}
+
+func testJob(id string, memory int) *api.Job {
+	job := api.NewBatchJob(id, id, "global", 50)
+	task := api.NewTask("job", "docker")
+	task.Resources = &api.Resources{CPU: internals.Ptr(100), MemoryMB: internals.Ptr(memory)}
+	job.AddTaskGroup(api.NewTaskGroup("job", 1).AddTask(task))
+	return job
+}
+
+func TestWaitForPlacement(t *testing.T) {
+	tests := []struct {
+		name    string
+		unblock bool
+		err     bool
+	}{
+		{name: "unblocked", unblock: true},
+		{name: "timeout", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, nomad := newTestNomad(t)
+			server.SetBlocked(true)
+
+			registration, err := nomad.RegisterJob(testJob("blocked", 256))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if registration.Status != internals.RegistrationBlocked || len(registration.PlacementFailures()) == 0 {
+				t.Fatalf("RegisterJob() = %+v, want a blocked registration", registration)
+			}
+			if test.unblock {
+				time.AfterFunc(200*time.Millisecond, func() { server.SetBlocked(false) })
+			}
+
+			progress := 0
+			registration, err = nomad.WaitForPlacement(registration, time.Second, 50*time.Millisecond, func(time.Duration, *internals.Registration) {
+				progress++
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("WaitForPlacement() error = %v, want error %v", err, test.err)
+			}
+			if progress == 0 {
+				t.Errorf("WaitForPlacement() did not report its progress")
+			}
+			allocs := server.Allocations("blocked")
+			if test.unblock && (registration.Status != internals.RegistrationPlaced || len(allocs) != 1) {
+				t.Errorf("WaitForPlacement() = %+v with %d allocations, want the job placed", registration, len(allocs))
+			}
+			if !test.unblock && (registration.Status != internals.RegistrationBlocked || len(allocs) != 0) {
+				t.Errorf("WaitForPlacement() = %+v with %d allocations, want the job blocked", registration, len(allocs))
+			}
+		})
+	}
+}
+
+func TestWaitForAllocation(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("event stream disabled %v", disabled), func(t *testing.T) {
+			server, nomad := newTestNomad(t)
+			server.DisableEventStream = disabled
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			_, err := nomad.RegisterJob(testJob("pending", 256))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := server.Allocations("pending")[0]
+			server.SetAllocationStatus(pending.ID, api.AllocClientStatusPending)
+			time.AfterFunc(200*time.Millisecond, func() {
+				server.SetAllocationStatus(pending.ID, api.AllocClientStatusRunning)
+			})
+
+			alloc, dead, err := nomad.WaitForAllocation("pending")
+			if err != nil {
+				t.Fatalf("WaitForAllocation() error = %v", err)
+			}
+			if alloc.ID != pending.ID || alloc.ClientStatus != api.AllocClientStatusRunning || dead {
+				t.Errorf("WaitForAllocation() = %s %s, %v, want the running allocation", alloc.ID, alloc.ClientStatus, dead)
+			}
+			if fallback := strings.Contains(logs.String(), "falling back to blocking queries"); fallback != disabled {
+				t.Errorf("fell back to blocking queries = %v, want %v", fallback, disabled)
+			}
+		})
+	}
+}
+
+func TestGetTaskLogs(t *testing.T) {
+	server, nomad := newTestNomad(t)
+	_, err := nomad.RegisterJob(testJob("logs", 256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, _, err := nomad.WaitForAllocation("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.WriteFile(alloc.ID, "alloc/logs/job.stderr.0", "exec: not found\n")
+
+	logs, err := nomad.GetTaskLogs(alloc, "job", "stderr")
+	if err != nil || logs != "exec: not found\n" {
+		t.Errorf("GetTaskLogs() = %q, %v, want the stderr log", logs, err)
+	}
+	if _, err := nomad.GetTaskLogs(alloc, "other", "stderr"); err == nil {
+		t.Errorf("GetTaskLogs() of an unknown task succeeded")
+	}
+}
+
+func TestSelectCluster(t *testing.T) {
+	busy := nomadtest.NewServer()
+	t.Cleanup(busy.Close)
+	idle := nomadtest.NewServer()
+	t.Cleanup(idle.Close)
+	down := nomadtest.NewServer()
+	down.Close()
+
+	// Half of the memory of the busy cluster is allocated.
+	var c config.Config
+	c.Nomad.Address = busy.URL
+	nomad, err := internals.NewNomad(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nomad.RegisterJob(testJob("busy", 4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		selection string
+		clusters  []string
+		want      string
+		err       bool
+	}{
+		{name: "failover", selection: config.ClusterSelectionFailover, clusters: []string{"busy", "idle"}, want: "busy"},
+		{name: "failover unhealthy", selection: config.ClusterSelectionFailover, clusters: []string{"down", "idle"}, want: "idle"},
+		{name: "least loaded", selection: config.ClusterSelectionLeastLoaded, clusters: []string{"busy", "idle"}, want: "idle"},
+		{name: "least loaded unhealthy", selection: config.ClusterSelectionLeastLoaded, clusters: []string{"idle", "down"}, want: "idle"},
+		{name: "all unhealthy", selection: config.ClusterSelectionFailover, clusters: []string{"down", "down"}, err: true},
+	}
+	addresses := map[string]string{"busy": busy.URL, "idle": idle.URL, "down": down.URL}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := config.Config{ClusterSelection: test.selection}
+			for _, name := range test.clusters {
+				c.Clusters = append(c.Clusters, &config.Nomad{Name: name, Address: addresses[name]})
+			}
+			got, err := internals.SelectCluster(c)
+			if (err != nil) != test.err {
+				t.Fatalf("SelectCluster() error = %v, want error %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("SelectCluster() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,828 @@
+// Package nomadtest provides an in-process fake of the Nomad HTTP API, covering
+// the endpoints used by giruno, so the executor stages can run without a
+// cluster.
+package nomadtest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"giruno/internals"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/nomad/api"
+)
+
+// ExecFunc handles a command executed in a task of an allocation and returns
+// its exit code.
+type ExecFunc func(alloc *api.Allocation, task string, command []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// Server is a fake Nomad agent. Registered jobs are placed immediately as a
+// single running allocation per task group, unless the server is blocked.
+type Server struct {
+	*httptest.Server
+
+	// Shell is written to the stdout log of every task when it is placed, as
+	// the executor keepalive script does.
+	Shell string
+	// Exec handles the commands executed in allocations. By default stdin is
+	// discarded and the exit code is 0.
+	Exec ExecFunc
+	// ParseJob parses the jobspecs sent to the parse endpoint, which is
+	// unavailable when it is nil since the fake does not embed a parser.
+	ParseJob func(jobHCL string) (*api.Job, error)
+	// DisableEventStream makes the event stream endpoint unavailable, as when
+	// it is disabled on the servers.
+	DisableEventStream bool
+
+	mu      sync.Mutex
+	changed chan struct{}
+	index   uint64
+	blocked bool
+	jobs    map[string]*api.Job
+	evals   map[string]*api.Evaluation
+	allocs  map[string]*api.Allocation
+	files   map[string]map[string]string
+	vars    map[string]*api.Variable
+	tokens  map[string]*api.ACLToken
+}
+
+// NewServer starts a fake Nomad agent, it must be closed by the caller.
+func NewServer() *Server {
+	s := &Server{
+		Shell:   "/bin/sh",
+		changed: make(chan struct{}),
+		index:   1,
+		jobs:    map[string]*api.Job{},
+		evals:   map[string]*api.Evaluation{},
+		allocs:  map[string]*api.Allocation{},
+		files:   map[string]map[string]string{},
+		vars:    map[string]*api.Variable{},
+		tokens:  map[string]*api.ACLToken{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/validate/job", s.handleValidate)
+	mux.HandleFunc("/v1/jobs", s.handleRegister)
+	mux.HandleFunc("/v1/jobs/parse", s.handleParse)
+	mux.HandleFunc("/v1/job/", s.handleJob)
+	mux.HandleFunc("/v1/evaluation/", s.handleEvaluation)
+	mux.HandleFunc("/v1/allocation/", s.handleAllocation)
+	mux.HandleFunc("/v1/status/leader", s.handleLeader)
+	mux.HandleFunc("/v1/nodes", s.handleNodes)
+	mux.HandleFunc("/v1/allocations", s.handleAllocations)
+	mux.HandleFunc("/v1/node/", http.NotFound)
+	mux.HandleFunc("/v1/event/stream", s.handleEventStream)
+	mux.HandleFunc("/v1/client/fs/cat/", s.handleCat)
+	mux.HandleFunc("/v1/client/allocation/", s.handleExec)
+	mux.HandleFunc("/v1/var/", s.handleVariable)
+	mux.HandleFunc("/v1/acl/login", s.handleLogin)
+	mux.HandleFunc("/v1/acl/token/", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Job returns a registered job.
+func (s *Server) Job(id string) *api.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// Allocations returns the allocations of a job, most recent first.
+func (s *Server) Allocations(jobID string) []*api.Allocation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobAllocations(jobID)
+}
+
+// SetBlocked makes the evaluation of the following registrations blocked,
+// as when the cluster is full. Unblocking places the blocked jobs.
+func (s *Server) SetBlocked(blocked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked = blocked
+	if blocked {
+		return
+	}
+	for _, eval := range s.evals {
+		if eval.Status != api.EvalStatusBlocked {
+			continue
+		}
+		eval.Status = api.EvalStatusComplete
+		eval.FailedTGAllocs = nil
+		eval.ModifyIndex = s.bump()
+		s.place(s.jobs[eval.JobID], eval)
+	}
+}
+
+// SetAllocationStatus changes the client status of an allocation and of all
+// its tasks.
+func (s *Server) SetAllocationStatus(allocID string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	alloc, ok := s.allocs[allocID]
+	if !ok {
+		return
+	}
+	alloc.ClientStatus = status
+	task_state := api.AllocClientStatusRunning
+	if status == api.AllocClientStatusComplete || status == api.AllocClientStatusFailed {
+		task_state = "dead"
+	}
+	for _, state := range alloc.TaskStates {
+		state.State = task_state
+		state.Failed = status == api.AllocClientStatusFailed
+	}
+	s.touch(alloc)
+}
+
+// Variable returns a Nomad variable.
+func (s *Server) Variable(path string) *api.Variable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vars[path]
+}
+
+// Token returns an ACL token obtained by login, or nil if it was revoked.
+func (s *Server) Token(accessorID string) *api.ACLToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[accessorID]
+}
+
+// WriteFile sets the content of a file in an allocation directory.
+func (s *Server) WriteFile(allocID string, path string, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[allocID] == nil {
+		s.files[allocID] = map[string]string{}
+	}
+	s.files[allocID][path] = content
+}
+
+// bump increments the state index and wakes up blocking queries. It must be
+// called with the lock held.
+func (s *Server) bump() uint64 {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.index
+}
+
+func (s *Server) touch(alloc *api.Allocation) {
+	alloc.ModifyIndex = s.bump()
+	alloc.AllocModifyIndex = alloc.ModifyIndex
+	alloc.ModifyTime = time.Now().UnixNano()
+}
+
+// place creates a running allocation for each task group of a job.
+func (s *Server) place(job *api.Job, eval *api.Evaluation) {
+	for _, group := range job.TaskGroups {
+		alloc := &api.Allocation{
+			ID:            newID(),
+			Namespace:     eval.Namespace,
+			EvalID:        eval.ID,
+			Name:          fmt.Sprintf("%s.%s[0]", *job.ID, *group.Name),
+			NodeID:        "fake-node",
+			NodeName:      "fake-node",
+			JobID:         *job.ID,
+			Job:           job,
+			TaskGroup:     *group.Name,
+			DesiredStatus: "run",
+			ClientStatus:  api.AllocClientStatusRunning,
+			TaskStates:    map[string]*api.TaskState{},
+			CreateTime:    time.Now().UnixNano(),
+			AllocatedResources: &api.AllocatedResources{
+				Tasks: map[string]*api.AllocatedTaskResources{},
+			},
+		}
+		s.files[alloc.ID] = map[string]string{}
+		for _, task := range group.Tasks {
+			resources := &api.AllocatedTaskResources{}
+			if task.Resources != nil && task.Resources.CPU != nil {
+				resources.Cpu.CpuShares = int64(*task.Resources.CPU)
+			}
+			if task.Resources != nil && task.Resources.MemoryMB != nil {
+				resources.Memory.MemoryMB = int64(*task.Resources.MemoryMB)
+			}
+			alloc.AllocatedResources.Tasks[task.Name] = resources
+			alloc.TaskStates[task.Name] = &api.TaskState{
+				State:     api.AllocClientStatusRunning,
+				StartedAt: time.Now(),
+			}
+			s.files[alloc.ID]["alloc/logs/"+task.Name+".stdout.0"] = s.Shell + "\n"
+		}
+		s.touch(alloc)
+		alloc.CreateIndex = alloc.ModifyIndex
+		s.allocs[alloc.ID] = alloc
+	}
+}
+
+func (s *Server) jobAllocations(jobID string) []*api.Allocation {
+	var allocs []*api.Allocation
+	for _, alloc := range s.allocs {
+		if alloc.JobID == jobID {
+			allocs = append(allocs, alloc)
+		}
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		return allocs[i].CreateIndex > allocs[j].CreateIndex
+	})
+	return allocs
+}
+
+// wait implements blocking queries: it returns once the state index is
+// greater than the requested one or the wait time is elapsed.
+func (s *Server) wait(r *http.Request) {
+	min_index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait_time := 5 * time.Minute
+	if wait, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil {
+		wait_time = wait
+	}
+	timer := time.NewTimer(wait_time)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		index, changed := s.index, s.changed
+		s.mu.Unlock()
+		if index > min_index {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(s.index, 10))
+	w.Header().Set("X-Nomad-LastContact", "0")
+	w.Header().Set("X-Nomad-KnownLeader", "true")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	var req api.JobValidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := api.JobValidateResponse{DriverConfigValidated: true}
+	if req.Job == nil || req.Job.ID == nil || *req.Job.ID == "" {
+		res.ValidationErrors = []string{"missing job ID"}
+		res.Error = "1 error occurred:\n\t* missing job ID"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, res)
+}
+
+func (s *Server) handleParse(w http.ResponseWriter, r *http.Request) {
+	if s.ParseJob == nil {
+		http.Error(w, "job parsing is not supported", http.StatusNotImplemented)
+		return
+	}
+	var req api.JobsParseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := s.ParseJob(req.JobHCL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, job)
+}
+
+// handleVariable implements the variable endpoints, with check-and-set
+// writes and deletes.
+func (s *Server) handleVariable(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/var/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.vars[path]
+	if cas := r.URL.Query().Get("cas"); cas != "" && r.Method != http.MethodGet {
+		index, err := strconv.ParseUint(cas, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (current == nil && index != 0) || (current != nil && current.ModifyIndex != index) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			if current == nil {
+				current = &api.Variable{Path: path}
+			}
+			json.NewEncoder(w).Encode(current)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if current == nil {
+			http.Error(w, "variable not found", http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, current)
+	case http.MethodPut:
+		var variable api.Variable
+		if err := json.NewDecoder(r.Body).Decode(&variable); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		variable.Path = path
+		variable.ModifyIndex = s.bump()
+		variable.ModifyTime = time.Now().UnixNano()
+		variable.CreateIndex = variable.ModifyIndex
+		variable.CreateTime = variable.ModifyTime
+		if current != nil {
+			variable.CreateIndex = current.CreateIndex
+			variable.CreateTime = current.CreateTime
+		}
+		s.vars[path] = &variable
+		s.writeJSON(w, variable)
+	case http.MethodDelete:
+		delete(s.vars, path)
+		s.bump()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLogin exchanges any non-empty login token for a new ACL token, auth
+// methods are not verified.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req api.ACLLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AuthMethodName == "" || req.LoginToken == "" {
+		http.Error(w, "missing auth method or login token", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := &api.ACLToken{
+		AccessorID: newID(),
+		SecretID:   newID(),
+		Name:       req.AuthMethodName,
+		Type:       "client",
+		CreateTime: time.Now(),
+	}
+	token.CreateIndex = s.bump()
+	token.ModifyIndex = token.CreateIndex
+	s.tokens[token.AccessorID] = token
+	s.writeJSON(w, token)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	accessor := strings.TrimPrefix(r.URL.Path, "/v1/acl/token/")
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[accessor]; !ok {
+		http.Error(w, "ACL token not found", http.StatusNotFound)
+		return
+	}
+	delete(s.tokens, accessor)
+	s.bump()
+	s.writeJSON(w, nil)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req api.JobRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Job == nil || req.Job.ID == nil {
+		http.Error(w, "missing job", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := req.Job
+	job.Namespace = requestNamespace(r)
+	job.Status = internals.Ptr("running")
+	job.JobModifyIndex = internals.Ptr(s.bump())
+	s.jobs[*job.ID] = job
+
+	eval := &api.Evaluation{
+		ID:          newID(),
+		Namespace:   *job.Namespace,
+		JobID:       *job.ID,
+		Type:        "batch",
+		TriggeredBy: "job-register",
+		Status:      api.EvalStatusComplete,
+		CreateIndex: s.index,
+		ModifyIndex: s.index,
+	}
+	s.evals[eval.ID] = eval
+
+	if s.blocked {
+		blocked := &api.Evaluation{
+			ID:             newID(),
+			Namespace:      eval.Namespace,
+			JobID:          eval.JobID,
+			Type:           eval.Type,
+			TriggeredBy:    "queued-allocs",
+			Status:         api.EvalStatusBlocked,
+			PreviousEval:   eval.ID,
+			FailedTGAllocs: map[string]*api.AllocationMetric{},
+			CreateIndex:    s.index,
+			ModifyIndex:    s.index,
+		}
+		for _, group := range job.TaskGroups {
+			blocked.FailedTGAllocs[*group.Name] = &api.AllocationMetric{
+				NodesEvaluated:     1,
+				NodesExhausted:     1,
+				NodesAvailable:     map[string]int{"dc1": 1},
+				DimensionExhausted: map[string]int{"memory": 1},
+			}
+		}
+		eval.BlockedEval = blocked.ID
+		eval.FailedTGAllocs = blocked.FailedTGAllocs
+		s.evals[blocked.ID] = blocked
+	} else {
+		s.place(job, eval)
+	}
+
+	s.writeJSON(w, api.JobRegisterResponse{
+		EvalID:          eval.ID,
+		EvalCreateIndex: eval.CreateIndex,
+		JobModifyIndex:  *job.JobModifyIndex,
+	})
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/job/"), "/")
+	id, _ = url.PathUnescape(id)
+
+	switch {
+	case r.Method == http.MethodGet && sub == "allocations":
+		s.wait(r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		stubs := []*api.AllocationListStub{}
+		for _, alloc := range s.jobAllocations(id) {
+			stubs = append(stubs, stub(alloc))
+		}
+		s.writeJSON(w, stubs)
+	case r.Method == http.MethodGet && sub == "":
+		s.wait(r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		job, ok := s.jobs[id]
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, job)
+	case r.Method == http.MethodDelete && sub == "":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		job, ok := s.jobs[id]
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("purge") == "true" {
+			delete(s.jobs, id)
+		} else {
+			job.Stop = internals.Ptr(true)
+			job.Status = internals.Ptr("dead")
+		}
+		for _, alloc := range s.jobAllocations(id) {
+			alloc.DesiredStatus = "stop"
+			if alloc.ClientStatus == api.AllocClientStatusRunning || alloc.ClientStatus == api.AllocClientStatusPending {
+				alloc.ClientStatus = api.AllocClientStatusComplete
+				for _, state := range alloc.TaskStates {
+					state.State = "dead"
+				}
+			}
+			s.touch(alloc)
+		}
+		eval := &api.Evaluation{
+			ID:          newID(),
+			JobID:       id,
+			TriggeredBy: "job-deregister",
+			Status:      api.EvalStatusComplete,
+			CreateIndex: s.bump(),
+		}
+		eval.ModifyIndex = eval.CreateIndex
+		s.evals[eval.ID] = eval
+		s.writeJSON(w, api.JobDeregisterResponse{
+			EvalID:          eval.ID,
+			EvalCreateIndex: eval.CreateIndex,
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleLeader(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, s.Listener.Addr().String())
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, []*api.NodeListStub{
+		{
+			ID:                    "fake-node",
+			Name:                  "fake-node",
+			Datacenter:            "dc1",
+			Status:                "ready",
+			SchedulingEligibility: api.NodeSchedulingEligible,
+			NodeResources: &api.NodeResources{
+				Cpu:    api.NodeCpuResources{CpuShares: 4000},
+				Memory: api.NodeMemoryResources{MemoryMB: 8192},
+			},
+		},
+	})
+}
+
+// handleAllocations lists the running and pending allocations, which is what
+// the filter sent by giruno selects since filters are not evaluated.
+func (s *Server) handleAllocations(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stubs := []*api.AllocationListStub{}
+	for _, alloc := range s.allocs {
+		if alloc.ClientStatus != api.AllocClientStatusRunning && alloc.ClientStatus != api.AllocClientStatusPending {
+			continue
+		}
+		stubs = append(stubs, stub(alloc))
+	}
+	s.writeJSON(w, stubs)
+}
+
+func (s *Server) handleEvaluation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/evaluation/")
+	s.wait(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	eval, ok := s.evals[id]
+	if !ok {
+		http.Error(w, "eval not found", http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, eval)
+}
+
+func (s *Server) handleAllocation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/allocation/")
+	s.wait(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	alloc, ok := s.allocs[id]
+	if !ok {
+		http.Error(w, "alloc not found", http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, alloc)
+}
+
+func (s *Server) handleCat(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/client/fs/cat/")
+	s.mu.Lock()
+	content, ok := s.files[id][r.URL.Query().Get("path")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, content)
+}
+
+// eventStreamEvents mirrors api.Events without its error field.
+type eventStreamEvents struct {
+	Index  uint64
+	Events []api.Event
+}
+
+func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if s.DisableEventStream {
+		http.Error(w, "event stream is disabled", http.StatusNotFound)
+		return
+	}
+	jobs := map[string]bool{}
+	for _, topic := range r.URL.Query()["topic"] {
+		name, key, _ := strings.Cut(topic, ":")
+		if name == string(api.TopicAllocation) || name == string(api.TopicAll) {
+			jobs[key] = true
+		}
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+
+	for r.Context().Err() == nil {
+		s.mu.Lock()
+		changed := s.changed
+		batch := eventStreamEvents{Index: s.index}
+		for _, alloc := range s.allocs {
+			if alloc.ModifyIndex < index || !(jobs[alloc.JobID] || jobs["*"]) {
+				continue
+			}
+			payload := *alloc
+			payload.Job = nil
+			batch.Events = append(batch.Events, api.Event{
+				Topic:      api.TopicAllocation,
+				Type:       "AllocationUpdated",
+				Key:        alloc.ID,
+				FilterKeys: []string{alloc.JobID},
+				Index:      alloc.ModifyIndex,
+				Payload:    map[string]interface{}{"Allocation": toMap(&payload)},
+			})
+		}
+		s.mu.Unlock()
+
+		if len(batch.Events) > 0 {
+			if err := encoder.Encode(batch); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		index = batch.Index + 1
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/client/allocation/"), "/")
+	if sub != "exec" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	alloc, ok := s.allocs[id]
+	exec := s.Exec
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "alloc not found", http.StatusNotFound)
+		return
+	}
+	var command []string
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("command")), &command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	task := r.URL.Query().Get("task")
+	if _, ok := alloc.TaskStates[task]; !ok {
+		http.Error(w, "unknown task name", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	stdin_r, stdin_w := io.Pipe()
+	go func() {
+		for {
+			var input api.ExecStreamingInput
+			if err := conn.ReadJSON(&input); err != nil {
+				stdin_w.CloseWithError(err)
+				return
+			}
+			if input.Stdin == nil {
+				continue
+			}
+			if len(input.Stdin.Data) > 0 {
+				stdin_w.Write(input.Stdin.Data)
+			}
+			if input.Stdin.Close {
+				stdin_w.Close()
+			}
+		}
+	}()
+
+	var write_lock sync.Mutex
+	send := func(frame api.ExecStreamingOutput) {
+		write_lock.Lock()
+		defer write_lock.Unlock()
+		conn.WriteJSON(frame)
+	}
+	stdout := writerFunc(func(p []byte) {
+		send(api.ExecStreamingOutput{Stdout: &api.ExecStreamingIOOperation{Data: p}})
+	})
+	stderr := writerFunc(func(p []byte) {
+		send(api.ExecStreamingOutput{Stderr: &api.ExecStreamingIOOperation{Data: p}})
+	})
+
+	code := 0
+	if exec != nil {
+		code = exec(alloc, task, command, stdin_r, stdout, stderr)
+	} else {
+		io.Copy(io.Discard, stdin_r)
+	}
+	send(api.ExecStreamingOutput{
+		Exited: true,
+		Result: &api.ExecStreamingExitResult{ExitCode: code},
+	})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+type writerFunc func(p []byte)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	f(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func stub(alloc *api.Allocation) *api.AllocationListStub {
+	return &api.AllocationListStub{
+		ID:                 alloc.ID,
+		EvalID:             alloc.EvalID,
+		Name:               alloc.Name,
+		Namespace:          alloc.Namespace,
+		NodeID:             alloc.NodeID,
+		NodeName:           alloc.NodeName,
+		JobID:              alloc.JobID,
+		TaskGroup:          alloc.TaskGroup,
+		DesiredStatus:      alloc.DesiredStatus,
+		ClientStatus:       alloc.ClientStatus,
+		TaskStates:         alloc.TaskStates,
+		AllocatedResources: alloc.AllocatedResources,
+		CreateIndex:        alloc.CreateIndex,
+		ModifyIndex:        alloc.ModifyIndex,
+		CreateTime:         alloc.CreateTime,
+		ModifyTime:         alloc.ModifyTime,
+	}
+}
+
+// toMap converts a value to its generic JSON representation, as event
+// payloads are decoded from.
+func toMap(v any) map[string]interface{} {
+	b, _ := json.Marshal(v)
+	m := map[string]interface{}{}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+func requestNamespace(r *http.Request) *string {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &namespace
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
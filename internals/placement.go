@@ -0,0 +1,87 @@
+package internals
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// DescribePlacementFailure explains in a single line why the scheduler could
+// not place a task group, e.g.
+// "0/12 nodes eligible: 7 filtered by constraint ${attr.cpu.arch} = arm64, 5 exhausted memory".
+func DescribePlacementFailure(metric *api.AllocationMetric) string {
+	total := 0
+	var empty_datacenters []string
+	for datacenter, count := range metric.NodesAvailable {
+		total += count
+		if count == 0 {
+			empty_datacenters = append(empty_datacenters, datacenter)
+		}
+	}
+	if total == 0 {
+		total = metric.NodesEvaluated
+	}
+	eligible := metric.NodesEvaluated - metric.NodesFiltered - metric.NodesExhausted
+	if eligible < 0 {
+		eligible = 0
+	}
+
+	var reasons []string
+	if metric.NodesEvaluated == 0 {
+		reasons = append(reasons, "no nodes were evaluated")
+	}
+	sort.Strings(empty_datacenters)
+	for _, datacenter := range empty_datacenters {
+		reasons = append(reasons, fmt.Sprintf("no nodes available in datacenter %s", datacenter))
+	}
+	reasons = append(reasons, countedReasons(metric.ConstraintFiltered, "filtered by constraint %s")...)
+	reasons = append(reasons, countedReasons(metric.ClassFiltered, "filtered by node class %s")...)
+	reasons = append(reasons, countedReasons(metric.DimensionExhausted, "exhausted %s")...)
+	reasons = append(reasons, countedReasons(metric.ClassExhausted, "exhausted in node class %s")...)
+	for _, quota := range metric.QuotaExhausted {
+		reasons = append(reasons, fmt.Sprintf("quota limit reached: %s", quota))
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no reason reported by the scheduler")
+	}
+
+	return fmt.Sprintf("%d/%d nodes eligible: %s", eligible, total, strings.Join(reasons, ", "))
+}
+
+// countedReasons formats node counts per reason, most frequent first.
+func countedReasons(counts map[string]int, format string) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	reasons := make([]string, 0, len(keys))
+	for _, key := range keys {
+		reasons = append(reasons, fmt.Sprintf("%d "+format, counts[key], key))
+	}
+	return reasons
+}
+
+// PlacementFailures describes the placement failure of each task group of the
+// registration, sorted by task group name.
+func (r *Registration) PlacementFailures() []string {
+	groups := make([]string, 0, len(r.FailedTGAllocs))
+	for group := range r.FailedTGAllocs {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	failures := make([]string, 0, len(groups))
+	for _, group := range groups {
+		failures = append(failures, fmt.Sprintf("task group %s: %s", group, DescribePlacementFailure(r.FailedTGAllocs[group])))
+	}
+	return failures
+}
@@ -0,0 +1,72 @@
+package internals
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestDescribePlacementFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric *api.AllocationMetric
+		want   string
+	}{
+		{
+			name: "constraint and exhaustion",
+			metric: &api.AllocationMetric{
+				NodesEvaluated:     12,
+				NodesFiltered:      7,
+				NodesExhausted:     5,
+				NodesAvailable:     map[string]int{"dc1": 12},
+				ConstraintFiltered: map[string]int{"${attr.cpu.arch} = arm64": 7},
+				DimensionExhausted: map[string]int{"memory": 5},
+			},
+			want: "0/12 nodes eligible: 7 filtered by constraint ${attr.cpu.arch} = arm64, 5 exhausted memory",
+		},
+		{
+			name: "empty datacenters",
+			metric: &api.AllocationMetric{
+				NodesAvailable: map[string]int{"dc2": 0, "dc1": 0},
+			},
+			want: "0/0 nodes eligible: no nodes were evaluated, no nodes available in datacenter dc1, no nodes available in datacenter dc2",
+		},
+		{
+			name: "most frequent reason first",
+			metric: &api.AllocationMetric{
+				NodesEvaluated:     5,
+				NodesExhausted:     5,
+				NodesAvailable:     map[string]int{"dc1": 5},
+				DimensionExhausted: map[string]int{"cpu": 2, "memory": 3},
+			},
+			want: "0/5 nodes eligible: 3 exhausted memory, 2 exhausted cpu",
+		},
+		{
+			name: "class filter and quota",
+			metric: &api.AllocationMetric{
+				NodesEvaluated: 4,
+				NodesFiltered:  1,
+				NodesAvailable: map[string]int{"dc1": 4},
+				ClassFiltered:  map[string]int{"gpu": 1},
+				QuotaExhausted: []string{"memory exhausted (8192 > 4096)"},
+			},
+			want: "3/4 nodes eligible: 1 filtered by node class gpu, quota limit reached: memory exhausted (8192 > 4096)",
+		},
+		{
+			name: "no reason",
+			metric: &api.AllocationMetric{
+				NodesEvaluated: 3,
+				NodesAvailable: map[string]int{"dc1": 3},
+			},
+			want: "3/3 nodes eligible: no reason reported by the scheduler",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := DescribePlacementFailure(test.metric)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package internals
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	retryAttempts = 6
+	retryMinDelay = 500 * time.Millisecond
+	retryMaxDelay = 15 * time.Second
+)
+
+var unexpectedResponseCode = regexp.MustCompile(`Unexpected response code: (\d+)`)
+
+// isRetryable reports whether a Nomad API error is transient: timeouts,
+// refused or reset connections, server errors and leader elections.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if match := unexpectedResponseCode.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		switch code {
+		case 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "no cluster leader") || strings.Contains(message, "no path to region") {
+		return true
+	}
+
+	// Certificate and TLS failures are configuration errors. They are checked
+	// first as the url.Error wrapping them is a net.Error.
+	var unknown_authority x509.UnknownAuthorityError
+	var invalid_certificate x509.CertificateInvalidError
+	var hostname_mismatch x509.HostnameError
+	var verification_error *tls.CertificateVerificationError
+	var record_header tls.RecordHeaderError
+	if errors.As(err, &unknown_authority) ||
+		errors.As(err, &invalid_certificate) ||
+		errors.As(err, &hostname_mismatch) ||
+		errors.As(err, &verification_error) ||
+		errors.As(err, &record_header) {
+		return false
+	}
+
+	var net_err net.Error
+	return (errors.As(err, &net_err) && net_err.Timeout()) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retry calls f until it succeeds, fails with a permanent error or the
+// attempts are exhausted, waiting with a jittered exponential backoff between
+// attempts.
+func retry(ctx context.Context, operation string, f func() error) error {
+	delay := retryMinDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt == retryAttempts || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("Nomad %s failed (attempt %d/%d), retrying in %s: %v", operation, attempt, retryAttempts, wait.Round(time.Millisecond), err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
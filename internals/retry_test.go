@@ -0,0 +1,57 @@
+package internals
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://nomad:4646/v1/jobs", Err: err}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", errors.New("Unexpected response code: 503 (rpc error: No cluster leader)"), true},
+		{"rate limited", errors.New("Unexpected response code: 429 (too many requests)"), true},
+		{"client error", errors.New("Unexpected response code: 404 (job not found)"), false},
+		{"permission denied", errors.New("Unexpected response code: 403 (Permission denied)"), false},
+		{"no leader", errors.New("rpc error: No cluster leader"), true},
+		{"canceled", fmt.Errorf("query: %w", context.Canceled), false},
+		{"deadline", urlError(context.DeadlineExceeded), false},
+		{"timeout", urlError(timeoutError{}), true},
+		{"connection refused", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"connection reset", urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"connection closed", urlError(io.EOF), true},
+		{"unknown host", urlError(&net.DNSError{Err: "no such host", Name: "nomad", IsNotFound: true}), false},
+		{"unknown authority", urlError(x509.UnknownAuthorityError{}), false},
+		{"certificate verification", urlError(&tls.CertificateVerificationError{Err: x509.HostnameError{Host: "nomad"}}), false},
+		{"not TLS", urlError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := isRetryable(test.err)
+			if got != test.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
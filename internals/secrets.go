@@ -0,0 +1,78 @@
+package internals
+
+import (
+	"fmt"
+	"giruno/gitlab"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// vaultSecretTemplate returns the consul-template expression rendering the
+// field of a Vault secret, as a JSON string when quoted.
+func vaultSecretTemplate(secret *gitlab.VaultSecret, quoted bool) (string, error) {
+	pipe := ""
+	if quoted {
+		pipe = " | toJSON"
+	}
+	switch secret.Engine.Name {
+	case "kv-v2", "":
+		return fmt.Sprintf(`{{ with secret %q }}{{ index .Data.data %q%s }}{{ end }}`,
+			path.Join(secret.Engine.Path, "data", secret.Path), secret.Field, pipe), nil
+	case "kv-v1":
+		return fmt.Sprintf(`{{ with secret %q }}{{ index .Data %q%s }}{{ end }}`,
+			path.Join(secret.Engine.Path, secret.Path), secret.Field, pipe), nil
+	default:
+		return "", fmt.Errorf("unsupported Vault secrets engine '%s'", secret.Engine.Name)
+	}
+}
+
+// SecretTemplates translates the secrets of a job into Nomad templates
+// rendered by the Nomad client from Vault. File secrets are rendered in the
+// task secrets directory and their variable is set to the file path, the other
+// ones are rendered as environment variables quoted as JSON strings, so that
+// multi-line values stay on their line.
+func SecretTemplates(secrets map[string]gitlab.Secret) ([]*api.Template, map[string]string, error) {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var templates []*api.Template
+	env := map[string]string{}
+	var env_template strings.Builder
+	for _, name := range names {
+		secret := secrets[name]
+		if secret.Vault == nil {
+			return nil, nil, fmt.Errorf("secret %s: only Vault secrets are supported", name)
+		}
+		file := secret.File == nil || *secret.File
+		tmpl, err := vaultSecretTemplate(secret.Vault, !file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+
+		if file {
+			templates = append(templates, &api.Template{
+				EmbeddedTmpl: Ptr(tmpl),
+				DestPath:     Ptr("secrets/" + name),
+				ChangeMode:   Ptr("noop"),
+			})
+			env[name] = "${NOMAD_SECRETS_DIR}/" + name
+		} else {
+			fmt.Fprintf(&env_template, "%s=%s\n", name, tmpl)
+		}
+	}
+	if env_template.Len() > 0 {
+		templates = append(templates, &api.Template{
+			EmbeddedTmpl: Ptr(env_template.String()),
+			DestPath:     Ptr("secrets/giruno.env"),
+			ChangeMode:   Ptr("noop"),
+			Envvars:      Ptr(true),
+		})
+	}
+	return templates, env, nil
+}
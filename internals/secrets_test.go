@@ -0,0 +1,137 @@
+package internals
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+
+	"giruno/gitlab"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestSecretTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		secrets   map[string]gitlab.Secret
+		templates []*api.Template
+		env       map[string]string
+		err       bool
+	}{
+		{
+			name: "kv-v2 file secret",
+			secrets: map[string]gitlab.Secret{
+				"DB_PASSWORD": {Vault: &gitlab.VaultSecret{
+					Engine: gitlab.VaultEngine{Name: "kv-v2", Path: "kv"},
+					Path:   "ci/db",
+					Field:  "password",
+				}},
+			},
+			templates: []*api.Template{
+				{
+					EmbeddedTmpl: Ptr(`{{ with secret "kv/data/ci/db" }}{{ index .Data.data "password" }}{{ end }}`),
+					DestPath:     Ptr("secrets/DB_PASSWORD"),
+					ChangeMode:   Ptr("noop"),
+				},
+			},
+			env: map[string]string{"DB_PASSWORD": "${NOMAD_SECRETS_DIR}/DB_PASSWORD"},
+		},
+		{
+			name: "kv-v1 variable secrets",
+			secrets: map[string]gitlab.Secret{
+				"TOKEN": {File: Ptr(false), Vault: &gitlab.VaultSecret{
+					Engine: gitlab.VaultEngine{Name: "kv-v1", Path: "secret"},
+					Path:   "ci",
+					Field:  "token",
+				}},
+				"API_KEY": {File: Ptr(false), Vault: &gitlab.VaultSecret{
+					Engine: gitlab.VaultEngine{Name: "kv-v1", Path: "secret"},
+					Path:   "ci",
+					Field:  "key",
+				}},
+			},
+			templates: []*api.Template{
+				{
+					EmbeddedTmpl: Ptr("API_KEY={{ with secret \"secret/ci\" }}{{ index .Data \"key\" | toJSON }}{{ end }}\n" +
+						"TOKEN={{ with secret \"secret/ci\" }}{{ index .Data \"token\" | toJSON }}{{ end }}\n"),
+					DestPath:   Ptr("secrets/giruno.env"),
+					ChangeMode: Ptr("noop"),
+					Envvars:    Ptr(true),
+				},
+			},
+			env: map[string]string{},
+		},
+		{
+			name: "unsupported engine",
+			secrets: map[string]gitlab.Secret{
+				"CERT": {Vault: &gitlab.VaultSecret{
+					Engine: gitlab.VaultEngine{Name: "pki", Path: "pki"},
+					Path:   "issue/ci",
+					Field:  "certificate",
+				}},
+			},
+			err: true,
+		},
+		{
+			name: "not a Vault secret",
+			secrets: map[string]gitlab.Secret{
+				"AZURE": {},
+			},
+			err: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templates, env, err := SecretTemplates(test.secrets)
+			if (err != nil) != test.err {
+				t.Fatalf("SecretTemplates() error = %v, want error %v", err, test.err)
+			}
+			if !reflect.DeepEqual(templates, test.templates) {
+				t.Errorf("SecretTemplates() templates = %v, want %v", templates, test.templates)
+			}
+			if !reflect.DeepEqual(env, test.env) {
+				t.Errorf("SecretTemplates() env = %v, want %v", env, test.env)
+			}
+		})
+	}
+}
+
+func TestSecretTemplatesMultiline(t *testing.T) {
+	templates, _, err := SecretTemplates(map[string]gitlab.Secret{
+		"CERT": {File: Ptr(false), Vault: &gitlab.VaultSecret{
+			Engine: gitlab.VaultEngine{Name: "kv-v2", Path: "kv"},
+			Path:   "ci/tls",
+			Field:  "cert",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Render the environment template like consul-template would.
+	funcs := template.FuncMap{
+		"secret": func(string) map[string]any {
+			return map[string]any{"Data": map[string]any{"data": map[string]any{
+				"cert": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+			}}}
+		},
+		"toJSON": func(value any) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+	}
+	tmpl, err := template.New("env").Funcs(funcs).Parse(*templates[0].EmbeddedTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env strings.Builder
+	if err := tmpl.Execute(&env, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `CERT="-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"` + "\n"
+	if env.String() != want {
+		t.Errorf("rendered env = %q, want %q", env.String(), want)
+	}
+}
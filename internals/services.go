@@ -0,0 +1,76 @@
+package internals
+
+import (
+	"fmt"
+	"giruno/gitlab"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+var referenceRegexpNoPort = regexp.MustCompile(`^(.*?)(|:[0-9]+)(|/.*)$`)
+
+var invalidPortLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+var invalidTaskNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+var invalidServiceNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// ServiceHostnames returns the hostnames a CI service is reachable at from the
+// job, as the Docker executor does: its aliases followed by the image name
+// without tag and registry port, with slashes replaced by "__" and by "-".
+func ServiceHostnames(image string, alias string) []string {
+	var hostnames []string
+	seen := map[string]bool{}
+	add := func(hostname string) {
+		if hostname != "" && !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	for _, a := range strings.Fields(strings.ReplaceAll(alias, ",", " ")) {
+		add(a)
+	}
+
+	match := reference.ReferenceRegexp.FindStringSubmatch(image)
+	if match == nil {
+		return hostnames
+	}
+	host_match := referenceRegexpNoPort.FindStringSubmatch(match[1])
+	service := host_match[1] + host_match[3]
+	add(strings.ReplaceAll(service, "/", "__"))
+	add(strings.ReplaceAll(service, "/", "-"))
+	return hostnames
+}
+
+// TaskName sanitizes a name to be used as a Nomad task name, which is also
+// used in file paths of the allocation directory.
+func TaskName(name string) string {
+	return strings.Trim(invalidTaskNameChars.ReplaceAllString(name, "-"), "-")
+}
+
+// PortLabel returns the Nomad port label of a port exposed by a CI image.
+func PortLabel(port gitlab.JobPort) string {
+	if port.Name == "" {
+		return fmt.Sprintf("port_%d", port.Number)
+	}
+	return invalidPortLabelChars.ReplaceAllString(port.Name, "_")
+}
+
+// ConsulServiceName returns the name a port of a CI service is registered with
+// in Consul, unique to the job. Service names are DNS labels, longer names are
+// shortened and suffixed with a hash of the full name.
+func ConsulServiceName(jobID string, task string, port int) string {
+	name := fmt.Sprintf("%s-%s-%d", jobID, task, port)
+	name = strings.Trim(invalidServiceNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > 63 {
+		hash := fnv.New32a()
+		hash.Write([]byte(name))
+		suffix := fmt.Sprintf("-%08x", hash.Sum32())
+		name = strings.TrimRight(name[:63-len(suffix)], "-") + suffix
+	}
+	return name
+}
@@ -0,0 +1,64 @@
+package internals
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceHostnames(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		alias string
+		want  []string
+	}{
+		{"docker hub image", "postgres:15", "", []string{"postgres"}},
+		{"namespaced image", "bitnami/redis:7", "", []string{"bitnami__redis", "bitnami-redis"}},
+		{"registry with port", "registry.example.com:5000/group/mysql:8", "db", []string{"db", "registry.example.com__group__mysql", "registry.example.com-group-mysql"}},
+		{"several aliases", "redis", "cache, queue store", []string{"cache", "queue", "store", "redis"}},
+		{"duplicate alias", "redis", "redis", []string{"redis"}},
+		{"invalid image", "Not An Image", "svc", []string{"svc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ServiceHostnames(test.image, test.alias)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ServiceHostnames(%q, %q) = %v, want %v", test.image, test.alias, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConsulServiceName(t *testing.T) {
+	tests := []struct {
+		name string
+		job  string
+		task string
+		port int
+		want string
+	}{
+		{"valid name", "runner-1-project-2-job-3", "service-postgres", 5432, "runner-1-project-2-job-3-service-postgres-5432"},
+		{"invalid characters", "Runner_1", "service-svc.db", 80, "runner-1-service-svc-db-80"},
+		{"longest name", "runner-12345-project-67890-job-1234567890", "service-postgres", 5432, "runner-12345-project-67890-job-1234567890-service-postgres-5432"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ConsulServiceName(test.job, test.task, test.port)
+			if got != test.want {
+				t.Errorf("ConsulServiceName(%q, %q, %d) = %q, want %q", test.job, test.task, test.port, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConsulServiceNameShortened(t *testing.T) {
+	job := "runner-12345-project-67890-job-1234567890"
+	name := ConsulServiceName(job, "service-postgresql", 5432)
+	if len(name) != 63 || !strings.HasPrefix(name, job+"-service-post-") {
+		t.Errorf("ConsulServiceName = %q, want a 63 characters name with a hash suffix", name)
+	}
+	if name == ConsulServiceName(job, "service-postgresql", 5433) {
+		t.Errorf("shortened service names of different ports collide")
+	}
+}
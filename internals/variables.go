@@ -0,0 +1,118 @@
+package internals
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// Items of the Nomad variables used as locks.
+const (
+	lockOwnerItem   = "owner"
+	lockExpiresItem = "expires"
+)
+
+func lockExpired(lock *api.Variable) bool {
+	expires, err := strconv.ParseInt(lock.Items[lockExpiresItem], 10, 64)
+	return err != nil || time.Now().Unix() >= expires
+}
+
+// AcquireLock takes the lock stored in a Nomad variable for an owner until
+// ttl elapses. It fails when another owner holds the lock and it did not
+// expire, e.g. because its cleanup stage never ran.
+func (n *Nomad) AcquireLock(path string, owner string, ttl time.Duration) (bool, error) {
+	q := (&api.WriteOptions{}).WithContext(n.ctx)
+	lock := &api.Variable{
+		Path: path,
+		Items: api.VariableItems{
+			lockOwnerItem:   owner,
+			lockExpiresItem: strconv.FormatInt(time.Now().Add(ttl).Unix(), 10),
+		},
+	}
+	err := retry(n.ctx, "lock acquisition", func() error {
+		_, _, err := n.client.Variables().CheckedCreate(lock, q)
+		return err
+	})
+	var conflict api.ErrCASConflict
+	if !errors.As(err, &conflict) {
+		return err == nil, err
+	}
+
+	held := conflict.Conflict
+	if held.Items[lockOwnerItem] != owner && !lockExpired(held) {
+		return false, nil
+	}
+	lock.ModifyIndex = held.ModifyIndex
+	err = retry(n.ctx, "lock acquisition", func() error {
+		_, _, err := n.client.Variables().CheckedUpdate(lock, q)
+		return err
+	})
+	if errors.As(err, &conflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLock releases a lock taken with AcquireLock, unless it was taken over
+// by another owner since.
+func (n *Nomad) ReleaseLock(path string, owner string) error {
+	q := (&api.QueryOptions{}).WithContext(n.ctx)
+	var lock *api.Variable
+	err := retry(n.ctx, "lock query", func() (err error) {
+		lock, _, err = n.client.Variables().Read(path, q)
+		return err
+	})
+	if errors.Is(err, api.ErrVariablePathNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lock.Items[lockOwnerItem] != owner {
+		return nil
+	}
+
+	w := (&api.WriteOptions{}).WithContext(n.ctx)
+	err = retry(n.ctx, "lock release", func() error {
+		_, err := n.client.Variables().CheckedDelete(path, lock.ModifyIndex, w)
+		return err
+	})
+	var conflict api.ErrCASConflict
+	if errors.As(err, &conflict) {
+		return nil
+	}
+	return err
+}
+
+// GetVariable returns the items of a Nomad variable of a namespace, or nil if
+// it does not exist.
+func (n *Nomad) GetVariable(namespace string, path string) (api.VariableItems, error) {
+	q := (&api.QueryOptions{Namespace: namespace}).WithContext(n.ctx)
+	var variable *api.Variable
+	err := retry(n.ctx, "variable query", func() (err error) {
+		variable, _, err = n.client.Variables().Read(path, q)
+		return err
+	})
+	if errors.Is(err, api.ErrVariablePathNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return variable.Items, nil
+}
+
+// PutVariable creates or replaces a Nomad variable of a namespace.
+func (n *Nomad) PutVariable(namespace string, path string, items api.VariableItems) error {
+	q := (&api.WriteOptions{Namespace: namespace}).WithContext(n.ctx)
+	return retry(n.ctx, "variable update", func() error {
+		_, _, err := n.client.Variables().Create(&api.Variable{
+			Namespace: namespace,
+			Path:      path,
+			Items:     items,
+		}, q)
+		return err
+	})
+}
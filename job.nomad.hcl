@@ -0,0 +1,105 @@
+# Job template, used when job_template_file = "job.nomad.hcl" is set in the
+# giruno configuration. It is a Nomad HCL2 jobspec whose giruno actions use
+# double square brackets. The job ID is set by giruno, the exec script and the
+# cache and builds volumes are added to the "job" and "helper" tasks. The
+# Volumes value maps the names of these volumes to their destinations, e.g. to
+# mount them in other tasks.
+job [[.ID | hcl]] {
+  type        = "batch"
+  datacenters = [[.Datacenters | hcl]]
+
+  group "job" {
+    restart {
+      attempts = 0
+    }
+
+    reschedule {
+      attempts  = 0
+      unlimited = false
+    }
+
+    # Services are reached on the loopback address, which the tasks only
+    # share in bridge mode.
+    network {
+      mode = "bridge"
+      [[- range .PortLabels]]
+      port [[. | hcl]] {}
+      [[- end]]
+    }
+
+    task "job" {
+      driver = "docker"
+      leader = true
+
+      config {
+        image      = [[.Image | hcl]]
+        force_pull = [[.ForcePull]]
+        [[- if gt (len .Entrypoint) 0]]
+        entrypoint = [[.Entrypoint | hcl]]
+        [[- else]]
+        command = "sh"
+        [[- end]]
+        args        = [ [[.ExecScript | hcl]] ]
+        extra_hosts = [[.ExtraHosts | hcl]]
+        ports       = [[.PortLabels | hcl]]
+        [[- with .Auth]]
+        auth {
+          username = [[.Username | hcl]]
+          password = [[.Password | hcl]]
+        }
+        [[- end]]
+      }
+
+      env = [[.ImageVariables | hcl]]
+    }
+
+    task "helper" {
+      driver = "docker"
+
+      config {
+        image       = [[.HelperImage | hcl]]
+        force_pull  = [[.HelperForcePull]]
+        command     = "sh"
+        args        = [ [[.ExecScript | hcl]] ]
+        extra_hosts = [[.ExtraHosts | hcl]]
+        [[- with .HelperAuth]]
+        auth {
+          username = [[.Username | hcl]]
+          password = [[.Password | hcl]]
+        }
+        [[- end]]
+      }
+    }
+    [[- range .Services]]
+
+    task [[.TaskName | hcl]] {
+      driver = "docker"
+
+      lifecycle {
+        hook    = "prestart"
+        sidecar = true
+      }
+
+      config {
+        image      = [[.Service.Name | hcl]]
+        force_pull = [[.ForcePull]]
+        [[- with deref .Service.Entrypoint]]
+        entrypoint = [[. | hcl]]
+        [[- end]]
+        [[- with deref .Service.Command]]
+        command = [[index . 0 | hcl]]
+        args    = [[slice . 1 | hcl]]
+        [[- end]]
+        [[- with .Auth]]
+        auth {
+          username = [[.Username | hcl]]
+          password = [[.Password | hcl]]
+        }
+        [[- end]]
+      }
+
+      env = [[.Variables | hcl]]
+    }
+    [[- end]]
+  }
+}